@@ -2,21 +2,68 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // API is a utility for communicating with the Mullvad API
+// Requests failing with a transport error or a 5xx status code are retried up to Retries times,
+// with a jittered exponential backoff starting at RetryDelay and capped at MaxRetryDelay
 type API struct {
-	Username string
-	Password string
-	BaseURL  string
-	Hostname string
-	Client   *http.Client
+	Username      string
+	Password      string
+	BaseURL       string
+	Hostname      string
+	Client        *http.Client
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	// Validators of the last list of wireguard peers, used for conditional requests
+	mu           sync.Mutex
+	etag         string
+	lastModified string
+	cursor       string
+}
+
+// ErrNotModified is returned by GetWireguardPeers when the list of peers hasn't changed since it was last fetched
+var ErrNotModified = errors.New("wireguard peers not modified")
+
+// ErrCursorExpired is returned by GetWireguardPeerDelta when the API no longer has the changes since the cursor
+var ErrCursorExpired = errors.New("wireguard peers cursor expired")
+
+// Header containing the delta cursor of a list of wireguard peers
+const cursorHeader = "X-Cursor"
+
+// StatusError is returned when the API responds with an unexpected status code
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from the api: %s", e.StatusCode, e.Body)
+}
+
+// Temporary returns whether the request may succeed if retried
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
 }
 
+// How much of the response body to include in a StatusError
+const maxErrorBodyLength = 512
+
 // WireguardPeerList is a list of Wireguard peers
 type WireguardPeerList []WireguardPeer
 
@@ -29,42 +76,171 @@ type WireguardPeer struct {
 	Pubkey string   `json:"pubkey"`
 }
 
+// WireguardPeerDelta contains the changes to the list of wireguard peers since a cursor, and the cursor to use for the next delta
+type WireguardPeerDelta struct {
+	Cursor  string            `json:"cursor"`
+	Added   WireguardPeerList `json:"added"`
+	Removed WireguardPeerList `json:"removed"`
+	Updated WireguardPeerList `json:"updated"`
+}
+
 // ConnectedKeysMap contains connected keys and their respective numer of keys
 type ConnectedKeysMap map[string]int
 
 // GetWireguardPeers fetches a list of wireguard peers from the API and returns it
+// If the list hasn't changed since the last call, ErrNotModified is returned instead
 func (a *API) GetWireguardPeers() (WireguardPeerList, error) {
-	req, err := http.NewRequest("GET", a.BaseURL+"/internal/active-wireguard-peers/", nil)
+	peers := WireguardPeerList{}
+	err := a.StreamWireguardPeers(func(peer WireguardPeer) error {
+		peers = append(peers, peer)
+		return nil
+	})
+
 	if err != nil {
 		return WireguardPeerList{}, err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Relay-Hostname", a.Hostname)
+	return peers, nil
+}
 
-	if a.Username != "" && a.Password != "" {
-		req.SetBasicAuth(a.Username, a.Password)
+// StreamWireguardPeers fetches the list of wireguard peers from the API, and calls fn for each peer as it's decoded
+// This avoids keeping the whole response in memory, and the list of peers if fn doesn't keep it
+// If the list hasn't changed since the last call, ErrNotModified is returned without calling fn
+// Callers that fail to apply the list should call ResetConditionalRequests, so that the next call returns it again
+func (a *API) StreamWireguardPeers(fn func(WireguardPeer) error) error {
+	header := http.Header{}
+	header.Set("Accept-Encoding", "gzip")
+
+	a.mu.Lock()
+	if a.etag != "" {
+		header.Set("If-None-Match", a.etag)
+	}
+	if a.lastModified != "" {
+		header.Set("If-Modified-Since", a.lastModified)
 	}
+	a.mu.Unlock()
 
-	response, err := a.Client.Do(req)
+	response, err := a.do("GET", "/internal/active-wireguard-peers/", header, nil)
 	if err != nil {
-		return WireguardPeerList{}, err
+		return err
 	}
 
 	defer response.Body.Close()
 
-	body, err := ioutil.ReadAll(response.Body)
+	if response.StatusCode == http.StatusNotModified {
+		return ErrNotModified
+	}
+
+	reader, err := decompress(response)
 	if err != nil {
-		return WireguardPeerList{}, err
+		return err
+	}
+	defer reader.Close()
+
+	err = DecodeWireguardPeers(reader, fn)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.etag = response.Header.Get("ETag")
+	a.lastModified = response.Header.Get("Last-Modified")
+	a.cursor = response.Header.Get(cursorHeader)
+	a.mu.Unlock()
+
+	return nil
+}
+
+// DecodeWireguardPeers decodes a JSON list of wireguard peers one at a time from r, and calls fn for each peer
+func DecodeWireguardPeers(r io.Reader, fn func(WireguardPeer) error) error {
+	decoder := json.NewDecoder(r)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("error decoding wireguard peers: %s", err.Error())
+	}
+
+	// A null list is treated as empty
+	if token == nil {
+		return nil
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("error decoding wireguard peers: expected a list, got %v", token)
+	}
+
+	for decoder.More() {
+		var peer WireguardPeer
+		err = decoder.Decode(&peer)
+		if err != nil {
+			return fmt.Errorf("error decoding wireguard peers: %s", err.Error())
+		}
+
+		err = fn(peer)
+		if err != nil {
+			return err
+		}
 	}
 
-	var decodedResponse WireguardPeerList
-	err = json.Unmarshal(body, &decodedResponse)
+	// Consume the closing bracket, to make sure the list is complete
+	_, err = decoder.Token()
 	if err != nil {
-		return WireguardPeerList{}, fmt.Errorf("error decoding wireguard peers")
+		return fmt.Errorf("error decoding wireguard peers: %s", err.Error())
+	}
+
+	return nil
+}
+
+// ResetConditionalRequests makes the next call to GetWireguardPeers return the list of peers even if it hasn't changed
+func (a *API) ResetConditionalRequests() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.etag = ""
+	a.lastModified = ""
+}
+
+// Cursor returns the delta cursor of the last list of wireguard peers fetched, if the API provided one
+func (a *API) Cursor() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.cursor
+}
+
+// GetWireguardPeerDelta fetches the changes to the list of wireguard peers since the given cursor
+// If the API no longer has the changes since the cursor, ErrCursorExpired is returned, and a full list has to be fetched instead
+func (a *API) GetWireguardPeerDelta(cursor string) (WireguardPeerDelta, error) {
+	header := http.Header{}
+	header.Set("Accept-Encoding", "gzip")
+
+	response, err := a.do("GET", "/internal/active-wireguard-peers/?since="+url.QueryEscape(cursor), header, nil)
+	if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusGone {
+		return WireguardPeerDelta{}, ErrCursorExpired
+	}
+	if err != nil {
+		return WireguardPeerDelta{}, err
+	}
+
+	defer response.Body.Close()
+
+	reader, err := decompress(response)
+	if err != nil {
+		return WireguardPeerDelta{}, err
+	}
+	defer reader.Close()
+
+	var delta WireguardPeerDelta
+	err = json.NewDecoder(reader).Decode(&delta)
+	if err != nil {
+		return WireguardPeerDelta{}, fmt.Errorf("error decoding wireguard peer delta: %s", err.Error())
+	}
+
+	if delta.Cursor == "" {
+		return WireguardPeerDelta{}, fmt.Errorf("error decoding wireguard peer delta: no cursor")
 	}
 
-	return decodedResponse, nil
+	return delta, nil
 }
 
 // PostWireguardConnections posts the number of connected wireguard keys to the API
@@ -74,19 +250,26 @@ func (a *API) PostWireguardConnections(keys ConnectedKeysMap) error {
 
 	buffer := new(bytes.Buffer)
 	json.NewEncoder(buffer).Encode(connectionsMap)
-	req, err := http.NewRequest("POST", a.BaseURL+"/internal/wireguard-connection-report/", buffer)
+
+	response, err := a.do("POST", "/internal/wireguard-connection-report/", nil, buffer.Bytes())
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Relay-Hostname", a.Hostname)
+	defer response.Body.Close()
 
-	if a.Username != "" && a.Password != "" {
-		req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// PostWireguardPeerRejections reports the peers that were rejected by validation to the API, so that bad data can be fixed at the source
+func (a *API) PostWireguardPeerRejections(rejections []PeerRejection) error {
+	buffer := new(bytes.Buffer)
+	err := json.NewEncoder(buffer).Encode(map[string][]PeerRejection{"rejections": rejections})
+	if err != nil {
+		return err
 	}
 
-	response, err := a.Client.Do(req)
+	response, err := a.do("POST", "/internal/wireguard-peer-rejection-report/", nil, buffer.Bytes())
 	if err != nil {
 		return err
 	}
@@ -95,3 +278,134 @@ func (a *API) PostWireguardConnections(keys ConnectedKeysMap) error {
 
 	return nil
 }
+
+// Return a reader for the body of a response, which is decompressed if needed
+func decompress(response *http.Response) (io.ReadCloser, error) {
+	if response.Header.Get("Content-Encoding") != "gzip" {
+		return ioutil.NopCloser(response.Body), nil
+	}
+
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing response: %s", err.Error())
+	}
+
+	return reader, nil
+}
+
+// Perform a request against the API, retrying on transport errors and temporary status codes
+// A response is only returned if it has a 2xx or 304 status code, otherwise a *StatusError is returned
+func (a *API) do(method string, path string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		response, retryAfter, err := a.doOnce(method, path, header, body)
+		if err == nil {
+			return response, nil
+		}
+
+		if statusErr, ok := err.(*StatusError); ok && !statusErr.Temporary() {
+			return nil, err
+		}
+
+		if attempt >= a.Retries {
+			return nil, err
+		}
+
+		delay := a.retryDelay(attempt)
+		if retryAfter > 0 {
+			// Give up rather than wait for longer than we're willing to
+			if a.MaxRetryDelay > 0 && retryAfter > a.MaxRetryDelay {
+				return nil, err
+			}
+
+			delay = retryAfter
+		}
+
+		log.Printf("error performing api request %s %s, retrying in %s: %s", method, path, delay, err.Error())
+		time.Sleep(delay)
+	}
+}
+
+// Perform a single request against the API, returning the delay requested by the Retry-After header on errors
+func (a *API) doOnce(method string, path string, header http.Header, body []byte) (*http.Response, time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, a.BaseURL+path, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	a.Authorize(req)
+
+	response, err := a.Client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if (response.StatusCode >= 200 && response.StatusCode < 300) || response.StatusCode == http.StatusNotModified {
+		return response, 0, nil
+	}
+
+	defer response.Body.Close()
+
+	excerpt, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBodyLength))
+
+	return nil, parseRetryAfter(response.Header.Get("Retry-After")), &StatusError{
+		StatusCode: response.StatusCode,
+		Body:       string(excerpt),
+	}
+}
+
+// Authorize adds the credentials and hostname of the relay to a request, for requests to the API made outside of this package
+func (a *API) Authorize(req *http.Request) {
+	req.Header.Set("X-Relay-Hostname", a.Hostname)
+
+	if a.Username != "" && a.Password != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+}
+
+// Calculate the delay before the given retry attempt, with jitter so that relays don't retry in lockstep
+func (a *API) retryDelay(attempt int) time.Duration {
+	delay := a.RetryDelay
+	for i := 0; i < attempt && (a.MaxRetryDelay <= 0 || delay < a.MaxRetryDelay); i++ {
+		delay *= 2
+	}
+
+	if a.MaxRetryDelay > 0 && delay > a.MaxRetryDelay {
+		delay = a.MaxRetryDelay
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	// Use a random delay between half and the full delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Parse a Retry-After header, which is either a number of seconds or a HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
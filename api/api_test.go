@@ -1,14 +1,20 @@
 package api_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"reflect"
+	"runtime"
 	"strings"
 
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/mullvad/wg-manager/api"
 )
@@ -148,3 +154,387 @@ func TestPostWireguardPeers(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 }
+
+func TestPostWireguardPeerRejections(t *testing.T) {
+	rejections := []api.PeerRejection{{Pubkey: "invalid", Reason: api.ReasonInvalidPubkey, Message: "invalid public key"}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/internal/wireguard-peer-rejection-report/" {
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+		}
+
+		var report map[string][]api.PeerRejection
+		err := json.NewDecoder(req.Body).Decode(&report)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if !reflect.DeepEqual(report["rejections"], rejections) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", rejections, report["rejections"])
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	err := a.PostWireguardPeerRejections(rejections)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte(strings.Repeat("x", 1024)))
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+		Retries: 3,
+	}
+
+	_, err := a.GetWireguardPeers()
+	statusErr, ok := err.(*api.StatusError)
+	if !ok {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+
+	if statusErr.StatusCode != http.StatusUnauthorized || len(statusErr.Body) != 512 {
+		t.Fatalf("unexpected status error %+v", statusErr)
+	}
+
+	err = a.PostWireguardConnections(connectedKeysFixture)
+	if _, ok := err.(*api.StatusError); !ok {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Retries       int
+		Failures      int
+		RetryAfter    string
+		ExpectedCalls int
+		ExpectedError bool
+	}{
+		{"success after failures", 3, 2, "", 3, false},
+		{"too many failures", 1, 2, "", 2, true},
+		{"no retries", 0, 1, "", 1, true},
+		{"retry after", 1, 1, "0", 2, false},
+		{"retry after too long", 3, 1, "3600", 1, true},
+	}
+
+	for _, test := range tests {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			calls++
+			if calls <= test.Failures {
+				if test.RetryAfter != "" {
+					rw.Header().Set("Retry-After", test.RetryAfter)
+				}
+
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			bytes, _ := json.Marshal(peerFixture)
+			rw.Write(bytes)
+		}))
+
+		a := api.API{
+			BaseURL:       server.URL,
+			Client:        server.Client(),
+			Retries:       test.Retries,
+			RetryDelay:    time.Millisecond,
+			MaxRetryDelay: time.Millisecond * 10,
+		}
+
+		peers, err := a.GetWireguardPeers()
+		server.Close()
+
+		if (err != nil) != test.ExpectedError {
+			t.Errorf("%s: unexpected error %v", test.Name, err)
+		}
+
+		if !test.ExpectedError && !reflect.DeepEqual(peers, peerFixture) {
+			t.Errorf("%s: got unexpected result, wanted %+v, got %+v", test.Name, peerFixture, peers)
+		}
+
+		if calls != test.ExpectedCalls {
+			t.Errorf("%s: got %d calls, expected %d", test.Name, calls, test.ExpectedCalls)
+		}
+	}
+}
+
+func TestRetryTransportError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.Close()
+
+	a := api.API{
+		BaseURL:    server.URL,
+		Client:     server.Client(),
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	}
+
+	_, err := a.GetWireguardPeers()
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	if _, ok := err.(*api.StatusError); ok {
+		t.Fatalf("expected a transport error, got %v", err)
+	}
+}
+
+func TestGetWireguardPeersConditional(t *testing.T) {
+	const etag = `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("gzip not accepted")
+		}
+
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		rw.Header().Set("ETag", etag)
+		rw.Header().Set("Content-Encoding", "gzip")
+
+		writer := gzip.NewWriter(rw)
+		json.NewEncoder(writer).Encode(peerFixture)
+		writer.Close()
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	peers, err := a.GetWireguardPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(peers, peerFixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", peerFixture, peers)
+	}
+
+	_, err = a.GetWireguardPeers()
+	if err != api.ErrNotModified {
+		t.Fatalf("expected the peers to not be modified, got %v", err)
+	}
+
+	a.ResetConditionalRequests()
+
+	peers, err = a.GetWireguardPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(peers, peerFixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", peerFixture, peers)
+	}
+}
+
+func TestDecodeWireguardPeers(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Body          string
+		ExpectedPeers int
+		ExpectedError bool
+	}{
+		{"list", `[{"pubkey":"a"},{"pubkey":"b"}]`, 2, false},
+		{"empty list", `[]`, 0, false},
+		{"null", `null`, 0, false},
+		{"object", `{"pubkey":"a"}`, 0, true},
+		{"truncated", `[{"pubkey":"a"},{"pub`, 1, true},
+		{"missing end", `[{"pubkey":"a"}`, 1, true},
+	}
+
+	for _, test := range tests {
+		peers := 0
+		err := api.DecodeWireguardPeers(strings.NewReader(test.Body), func(peer api.WireguardPeer) error {
+			peers++
+			return nil
+		})
+
+		if (err != nil) != test.ExpectedError {
+			t.Errorf("%s: unexpected error %v", test.Name, err)
+		}
+
+		if peers != test.ExpectedPeers {
+			t.Errorf("%s: got %d peers, expected %d", test.Name, peers, test.ExpectedPeers)
+		}
+	}
+}
+
+// Build a JSON list of peers similar to what the API returns for a large relay
+func largePeerListFixture(b *testing.B, count int) []byte {
+	b.Helper()
+
+	peers := make(api.WireguardPeerList, count)
+	for i := range peers {
+		peers[i] = api.WireguardPeer{
+			IPv4:   fmt.Sprintf("10.%d.%d.%d/32", i>>16&0xff, i>>8&0xff, i&0xff),
+			IPv6:   fmt.Sprintf("fc00:bbbb:bbbb:bb01::%x/128", i),
+			Ports:  []int{1234, 4321},
+			Cities: []string{"", "se-got"},
+			Pubkey: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%032d", i))),
+		}
+	}
+
+	body, err := json.Marshal(peers)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return body
+}
+
+// Run f while sampling the heap, and report the peak heap usage above what was in use before
+func reportPeakHeap(b *testing.B, f func()) {
+	b.Helper()
+
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > max {
+				max = stats.HeapAlloc
+			}
+
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	f()
+	close(done)
+
+	max := <-peak
+	if max < baseline {
+		max = baseline
+	}
+
+	b.ReportMetric(float64(max-baseline)/(1<<20), "peak-heap-MB")
+}
+
+const benchmarkPeerCount = 200000
+
+// The previous implementation, which read the whole body before unmarshalling it
+func BenchmarkDecodeWireguardPeersReadAll(b *testing.B) {
+	body := largePeerListFixture(b, benchmarkPeerCount)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	reportPeakHeap(b, func() {
+		for i := 0; i < b.N; i++ {
+			data, err := ioutil.ReadAll(bytes.NewReader(body))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			var peers api.WireguardPeerList
+			err = json.Unmarshal(data, &peers)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			for range peers {
+			}
+		}
+	})
+}
+
+func BenchmarkDecodeWireguardPeersStream(b *testing.B) {
+	body := largePeerListFixture(b, benchmarkPeerCount)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	reportPeakHeap(b, func() {
+		for i := 0; i < b.N; i++ {
+			err := api.DecodeWireguardPeers(bytes.NewReader(body), func(peer api.WireguardPeer) error {
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestGetWireguardPeerDelta(t *testing.T) {
+	delta := api.WireguardPeerDelta{
+		Cursor:  "2",
+		Added:   peerFixture,
+		Removed: peerWithoutCitiesFixtures,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Query().Get("since") {
+		case "":
+			rw.Header().Set("X-Cursor", "1")
+			json.NewEncoder(rw).Encode(peerFixture)
+		case "1":
+			json.NewEncoder(rw).Encode(delta)
+		default:
+			rw.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer server.Close()
+
+	a := api.API{
+		BaseURL: server.URL,
+		Client:  server.Client(),
+	}
+
+	_, err := a.GetWireguardPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Cursor() != "1" {
+		t.Fatalf("unexpected cursor %q", a.Cursor())
+	}
+
+	result, err := a.GetWireguardPeerDelta(a.Cursor())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, delta) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", delta, result)
+	}
+
+	_, err = a.GetWireguardPeerDelta("0")
+	if err != api.ErrCursorExpired {
+		t.Fatalf("expected the cursor to be expired, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// Action is what a WireguardEvent does, unknown actions are rejected when decoding events
+type Action string
+
+// The actions of events for a single peer
+const (
+	ActionAdd         Action = "ADD"
+	ActionRemove      Action = "REMOVE"
+	ActionUpdatePorts Action = "UPDATE_PORTS"
+)
+
+// ActionResync is sent by the server when the events since the last event ID can't be replayed, and a full synchronization is needed
+const ActionResync Action = "RESYNC"
+
+// ReasonInvalidAction is the reason an event with an unknown action is rejected for, used in metrics
+const ReasonInvalidAction = "invalid_action"
+
+// Valid returns whether the action is one of the known actions
+func (a Action) Valid() bool {
+	switch a {
+	case ActionAdd, ActionRemove, ActionUpdatePorts, ActionResync:
+		return true
+	default:
+		return false
+	}
+}
+
+// UnmarshalJSON decodes an action, returning an error for unknown actions
+func (a *Action) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	if !Action(s).Valid() {
+		return &api.ValidationError{Reason: ReasonInvalidAction, Message: fmt.Sprintf("unknown action %q", s)}
+	}
+
+	*a = Action(s)
+
+	return nil
+}
+
+// Validate returns a *api.ValidationError if the event can't be applied
+// Every action except RESYNC needs a valid peer
+func (e WireguardEvent) Validate() error {
+	if !e.Action.Valid() {
+		return &api.ValidationError{Reason: ReasonInvalidAction, Message: fmt.Sprintf("unknown action %q", e.Action)}
+	}
+
+	if e.Action == ActionResync {
+		return nil
+	}
+
+	return e.Peer.Validate()
+}
+
+// Count an event that couldn't be decoded, with the reason it was rejected for if it was invalid
+func countDecodeError(metrics *statsd.Client, prefix string, err error) {
+	metrics.Increment(prefix + "_decode_error")
+
+	var validationErr *api.ValidationError
+	if errors.As(err, &validationErr) {
+		metrics.Increment("invalid_event_" + validationErr.Reason)
+	}
+}
@@ -0,0 +1,75 @@
+package subscriber_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+var validFixture = subscriber.WireguardEvent{
+	Action: subscriber.ActionAdd,
+	Peer: api.WireguardPeer{
+		IPv4:   "10.99.0.1/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+		Ports:  []int{1234, 4321},
+		Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
+	},
+}
+
+func TestActionUnmarshalJSON(t *testing.T) {
+	for _, action := range []subscriber.Action{subscriber.ActionAdd, subscriber.ActionRemove, subscriber.ActionUpdatePorts, subscriber.ActionResync} {
+		var event subscriber.WireguardEvent
+		err := json.Unmarshal([]byte(`{"action":"`+string(action)+`"}`), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Action != action {
+			t.Fatalf("expected %s, got %s", action, event.Action)
+		}
+	}
+
+	for _, data := range []string{`{"action":"UNKNOWN"}`, `{"action":"add"}`, `{"action":""}`, `{"action":1}`} {
+		var event subscriber.WireguardEvent
+		err := json.Unmarshal([]byte(data), &event)
+		if err == nil {
+			t.Fatalf("no error for %s", data)
+		}
+	}
+}
+
+func TestEventValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  subscriber.WireguardEvent
+		reason string
+	}{
+		{"valid", validFixture, ""},
+		{"resync without peer", subscriber.WireguardEvent{Action: subscriber.ActionResync}, ""},
+		{"unknown action", subscriber.WireguardEvent{Action: "UNKNOWN", Peer: validFixture.Peer}, subscriber.ReasonInvalidAction},
+		{"add without peer", subscriber.WireguardEvent{Action: subscriber.ActionAdd}, api.ReasonInvalidPubkey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.event.Validate()
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			var validationErr *api.ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Reason != tt.reason {
+				t.Fatalf("expected %s, got %v", tt.reason, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package subscriber
+
+// Coalesce reduces the events to at most one per public key, with the same effect as applying all of them in order
+// Rules left behind by a coalesced event whose peer had different addresses or ports are removed by the next synchronization
+// The remaining events keep the position of the first event for their key, events for no peer in particular, such as RESYNC, are kept as is
+func Coalesce(events []WireguardEvent) []WireguardEvent {
+	var coalesced []WireguardEvent
+	index := make(map[string]int)
+
+	for _, event := range events {
+		switch event.Action {
+		case ActionAdd, ActionRemove, ActionUpdatePorts:
+		default:
+			coalesced = append(coalesced, event)
+			continue
+		}
+
+		i, ok := index[event.Peer.Pubkey]
+		if !ok {
+			index[event.Peer.Pubkey] = len(coalesced)
+			coalesced = append(coalesced, event)
+			continue
+		}
+
+		coalesced[i] = coalesceEvent(coalesced[i], event)
+	}
+
+	return coalesced
+}
+
+// Returns the single event with the same effect as applying previous and then next, for the same peer
+func coalesceEvent(previous, next WireguardEvent) WireguardEvent {
+	if next.Action != ActionUpdatePorts {
+		// ADD and REMOVE replace whatever happened to the peer before
+		return next
+	}
+
+	switch previous.Action {
+	case ActionAdd:
+		// The peer is added with the new ports straight away
+		next.Action = ActionAdd
+		return next
+	case ActionRemove:
+		// The peer is gone, there are no ports to update
+		return previous
+	default:
+		return next
+	}
+}
@@ -0,0 +1,67 @@
+package subscriber_test
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func coalesceFixture(action subscriber.Action, pubkey string, ports ...int) subscriber.WireguardEvent {
+	return subscriber.WireguardEvent{
+		Action: action,
+		Peer: api.WireguardPeer{
+			Pubkey: pubkey,
+			Ports:  ports,
+		},
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	add := coalesceFixture(subscriber.ActionAdd, "a", 1)
+	remove := coalesceFixture(subscriber.ActionRemove, "a", 1)
+	update := coalesceFixture(subscriber.ActionUpdatePorts, "a", 2)
+	addUpdated := coalesceFixture(subscriber.ActionAdd, "a", 2)
+	resync := subscriber.WireguardEvent{Action: subscriber.ActionResync}
+
+	tests := []struct {
+		name   string
+		events []subscriber.WireguardEvent
+		want   []subscriber.WireguardEvent
+	}{
+		{"no events", nil, nil},
+		{"single event", []subscriber.WireguardEvent{add}, []subscriber.WireguardEvent{add}},
+		{"add add", []subscriber.WireguardEvent{add, addUpdated}, []subscriber.WireguardEvent{addUpdated}},
+		{"add remove", []subscriber.WireguardEvent{add, remove}, []subscriber.WireguardEvent{remove}},
+		{"add update ports", []subscriber.WireguardEvent{add, update}, []subscriber.WireguardEvent{addUpdated}},
+		{"remove add", []subscriber.WireguardEvent{remove, add}, []subscriber.WireguardEvent{add}},
+		{"remove remove", []subscriber.WireguardEvent{remove, remove}, []subscriber.WireguardEvent{remove}},
+		{"remove update ports", []subscriber.WireguardEvent{remove, update}, []subscriber.WireguardEvent{remove}},
+		{"update ports add", []subscriber.WireguardEvent{update, add}, []subscriber.WireguardEvent{add}},
+		{"update ports remove", []subscriber.WireguardEvent{update, remove}, []subscriber.WireguardEvent{remove}},
+		{"update ports update ports", []subscriber.WireguardEvent{coalesceFixture(subscriber.ActionUpdatePorts, "a", 3), update}, []subscriber.WireguardEvent{update}},
+		{"add remove add", []subscriber.WireguardEvent{add, remove, addUpdated}, []subscriber.WireguardEvent{addUpdated}},
+		{"add update ports remove", []subscriber.WireguardEvent{add, update, remove}, []subscriber.WireguardEvent{remove}},
+		{"remove update ports add", []subscriber.WireguardEvent{remove, update, add}, []subscriber.WireguardEvent{add}},
+		{
+			"different keys keep their order",
+			[]subscriber.WireguardEvent{coalesceFixture(subscriber.ActionAdd, "b", 1), add, coalesceFixture(subscriber.ActionRemove, "b", 1), remove},
+			[]subscriber.WireguardEvent{coalesceFixture(subscriber.ActionRemove, "b", 1), remove},
+		},
+		{
+			"resync is kept",
+			[]subscriber.WireguardEvent{add, resync, remove, resync},
+			[]subscriber.WireguardEvent{remove, resync, resync},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := subscriber.Coalesce(tt.events)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("unexpected events (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// EventSource emits wireguard key events received from a message-queue
+// If the message-queue is unreachable, or the connection is lost, it's reestablished in the background until ctx is canceled
+type EventSource interface {
+	Subscribe(ctx context.Context, channel chan<- WireguardEvent)
+	State() State
+	LastConnected() time.Time
+}
+
+// WireguardEvent is a wireguard key event
+// The timestamp and signature are only set by publishers that sign events, see Verifier
+type WireguardEvent struct {
+	ID        uint64            `json:"id,omitempty"`
+	Action    Action            `json:"action"`
+	Peer      api.WireguardPeer `json:"peer"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Signature string            `json:"signature,omitempty"`
+
+	// The ID the event was delivered with outside of its data, such as the id field of a server-sent event
+	// It isn't part of the signed message, so it's kept apart from the ID the publisher set
+	TransportID string `json:"-"`
+}
+
+// Config contains the settings shared by all event sources
+type Config struct {
+	URL      string
+	Username string
+	Password string
+	Channel  string
+	Metrics  *statsd.Client
+
+	// Client used for websocket connections, and TLS configuration used for NATS and Redis
+	HTTPClient *http.Client
+	TLSConfig  *tls.Config
+
+	// API whose client, credentials and TLS configuration are used for server-sent events, instead of the settings above
+	API *api.API
+
+	// Name of the JetStream durable consumer to use for NATS, core NATS is used if empty
+	Durable string
+
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// How long server-sent event streams can go without receiving anything before they're reestablished
+	IdleTimeout time.Duration
+}
+
+// New returns the EventSource for the scheme of the URL
+// ws:// and wss:// use the message-queue websocket protocol, http:// and https:// use server-sent events,
+// nats:// and tls:// use NATS, and redis:// and rediss:// use Redis Pub/Sub
+func New(c Config) (EventSource, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "ws", "wss":
+		return &Subscriber{
+			Username:          c.Username,
+			Password:          c.Password,
+			BaseURL:           c.URL,
+			Channel:           c.Channel,
+			Metrics:           c.Metrics,
+			HTTPClient:        c.HTTPClient,
+			MinReconnectDelay: c.MinReconnectDelay,
+			MaxReconnectDelay: c.MaxReconnectDelay,
+		}, nil
+	case "http", "https":
+		if c.API == nil {
+			return nil, fmt.Errorf("server-sent events require an api")
+		}
+
+		return &SSE{
+			URL:               c.URL + "/channel/" + c.Channel,
+			API:               c.API,
+			Metrics:           c.Metrics,
+			MinReconnectDelay: c.MinReconnectDelay,
+			MaxReconnectDelay: c.MaxReconnectDelay,
+			IdleTimeout:       c.IdleTimeout,
+		}, nil
+	case "nats", "tls":
+		return &NATS{
+			URL:               c.URL,
+			Username:          c.Username,
+			Password:          c.Password,
+			Subject:           c.Channel,
+			Durable:           c.Durable,
+			Metrics:           c.Metrics,
+			TLSConfig:         c.TLSConfig,
+			MinReconnectDelay: c.MinReconnectDelay,
+			MaxReconnectDelay: c.MaxReconnectDelay,
+		}, nil
+	case "redis", "rediss":
+		return &Redis{
+			URL:               c.URL,
+			Username:          c.Username,
+			Password:          c.Password,
+			Channel:           c.Channel,
+			Metrics:           c.Metrics,
+			TLSConfig:         c.TLSConfig,
+			MinReconnectDelay: c.MinReconnectDelay,
+			MaxReconnectDelay: c.MaxReconnectDelay,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported message-queue url scheme %s", u.Scheme)
+	}
+}
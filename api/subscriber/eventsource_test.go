@@ -0,0 +1,97 @@
+package subscriber_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected subscriber.EventSource
+	}{
+		{"wss://example.com/mq", &subscriber.Subscriber{}},
+		{"ws://127.0.0.1:8080", &subscriber.Subscriber{}},
+		{"https://example.com/mq", &subscriber.SSE{}},
+		{"nats://127.0.0.1:4222", &subscriber.NATS{}},
+		{"tls://127.0.0.1:4222", &subscriber.NATS{}},
+		{"redis://127.0.0.1:6379/0", &subscriber.Redis{}},
+		{"rediss://127.0.0.1:6379/0", &subscriber.Redis{}},
+	}
+
+	for _, test := range tests {
+		source, err := subscriber.New(subscriber.Config{URL: test.url, API: &api.API{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch test.expected.(type) {
+		case *subscriber.Subscriber:
+			_, ok := source.(*subscriber.Subscriber)
+			if !ok {
+				t.Errorf("expected a websocket event source for %s, got %T", test.url, source)
+			}
+		case *subscriber.SSE:
+			_, ok := source.(*subscriber.SSE)
+			if !ok {
+				t.Errorf("expected a server-sent events event source for %s, got %T", test.url, source)
+			}
+		case *subscriber.NATS:
+			_, ok := source.(*subscriber.NATS)
+			if !ok {
+				t.Errorf("expected a nats event source for %s, got %T", test.url, source)
+			}
+		case *subscriber.Redis:
+			_, ok := source.(*subscriber.Redis)
+			if !ok {
+				t.Errorf("expected a redis event source for %s, got %T", test.url, source)
+			}
+		}
+	}
+
+	_, err := subscriber.New(subscriber.Config{URL: "amqp://127.0.0.1"})
+	if err == nil {
+		t.Fatal("no error for unsupported scheme")
+	}
+}
+
+func newMetrics(t *testing.T) *statsd.Client {
+	t.Helper()
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return metrics
+}
+
+func waitForState(t *testing.T, source subscriber.EventSource, state subscriber.State) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for source.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for state %s, in state %s", state, source.State())
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func receive(t *testing.T, channel <-chan subscriber.WireguardEvent) subscriber.WireguardEvent {
+	t.Helper()
+
+	select {
+	case msg := <-channel:
+		return msg
+	case <-time.After(time.Second * 10):
+		t.Fatal("timed out waiting for event")
+	}
+
+	return subscriber.WireguardEvent{}
+}
@@ -0,0 +1,148 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/nats-io/nats.go"
+)
+
+// NATS is an EventSource receiving wireguard key events from a NATS subject
+// If Durable is set, events are received through a JetStream durable consumer, so that events published while disconnected are replayed
+type NATS struct {
+	URL      string
+	Username string
+	Password string
+	Subject  string
+	Durable  string
+	Metrics  *statsd.Client
+
+	// TLS configuration used for tls:// urls, or if the server requires TLS
+	TLSConfig *tls.Config
+
+	// Reconnection attempts are made with a jittered exponential backoff, starting at MinReconnectDelay and capped at MaxReconnectDelay
+	// Defaults to one second and one minute respectively
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	connection
+}
+
+// Subscribe connects to NATS and subscribes to the subject, and emits events on the given channel
+func (n *NATS) Subscribe(ctx context.Context, channel chan<- WireguardEvent) {
+	n.setState(StateConnecting)
+
+	options := []nats.Option{
+		nats.Name("wg-manager"),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.CustomReconnectDelay(func(attempts int) time.Duration {
+			return reconnectDelay(n.MinReconnectDelay, n.MaxReconnectDelay, attempts-1)
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Println("error reading from nats, reconnecting", err)
+				n.Metrics.Increment("nats_error")
+			}
+
+			n.setState(StateDisconnected)
+		}),
+		// Also called when connecting for the first time fails, and is retried
+		nats.ReconnectHandler(func(*nats.Conn) {
+			log.Println("successfully connected to nats")
+			n.setState(StateConnected)
+		}),
+	}
+
+	if n.Username != "" && n.Password != "" {
+		options = append(options, nats.UserInfo(n.Username, n.Password))
+	}
+
+	// Only the configuration is set, nats.Secure would force TLS for nats:// urls as well
+	if n.TLSConfig != nil {
+		options = append(options, func(o *nats.Options) error {
+			o.TLSConfig = n.TLSConfig
+			return nil
+		})
+	}
+
+	conn, err := nats.Connect(n.URL, options...)
+	if err != nil {
+		log.Println("error connecting to nats, real-time events are unavailable", err)
+		n.Metrics.Increment("nats_connect_error")
+		n.setState(StateDisconnected)
+		return
+	}
+
+	if conn.IsConnected() {
+		n.setState(StateConnected)
+	} else {
+		log.Println("error connecting to nats, real-time events are unavailable until it's reachable")
+		n.Metrics.Increment("nats_connect_error")
+	}
+
+	go n.subscribe(ctx, conn, channel)
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		n.setState(StateDisconnected)
+	}()
+}
+
+// Subscribe to the subject, retrying until it succeeds
+// Once subscribed, the subscription is restored by the NATS client on reconnect
+func (n *NATS) subscribe(ctx context.Context, conn *nats.Conn, channel chan<- WireguardEvent) {
+	handler := func(msg *nats.Msg) {
+		event := WireguardEvent{}
+		err := json.Unmarshal(msg.Data, &event)
+		if err != nil {
+			log.Println("error decoding event from nats", err)
+			countDecodeError(n.Metrics, "nats", err)
+			return
+		}
+
+		// JetStream messages are acknowledged once the handler returns
+		select {
+		case channel <- event:
+		case <-ctx.Done():
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		var err error
+		if n.Durable == "" {
+			_, err = conn.Subscribe(n.Subject, handler)
+		} else {
+			// Looking up the consumer requires a connection, so this fails until connected
+			var js nats.JetStreamContext
+			js, err = conn.JetStream()
+			if err == nil {
+				_, err = js.Subscribe(n.Subject, handler, nats.Durable(n.Durable))
+			}
+		}
+
+		if err == nil {
+			return
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Println("error subscribing to nats", err)
+		n.Metrics.Increment("nats_subscribe_error")
+
+		if !sleep(ctx, reconnectDelay(n.MinReconnectDelay, n.MaxReconnectDelay, attempt)) {
+			return
+		}
+	}
+}
+
+func (n *NATS) setState(state State) {
+	n.connection.setState(n.Metrics, "nats", state)
+}
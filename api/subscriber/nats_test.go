@@ -0,0 +1,219 @@
+package subscriber_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api/subscriber"
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+const subject = "wireguard"
+
+func runNATSServer(t *testing.T, port int, jetStream bool) *server.Server {
+	t.Helper()
+
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+
+	if jetStream {
+		dir, err := ioutil.TempDir("", "wg-manager")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts.JetStream = true
+		opts.StoreDir = dir
+	}
+
+	return natsserver.RunServer(&opts)
+}
+
+func publishNATS(t *testing.T, s *server.Server, event subscriber.WireguardEvent) {
+	t.Helper()
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Publish(subject, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Core NATS only delivers events published after subscribing, so publish until one is received
+func publishNATSUntilReceived(t *testing.T, s *server.Server, channel <-chan subscriber.WireguardEvent) subscriber.WireguardEvent {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		publishNATS(t, s, fixture)
+
+		select {
+		case msg := <-channel:
+			return msg
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	t.Fatal("timed out waiting for event")
+	return subscriber.WireguardEvent{}
+}
+
+func TestNATS(t *testing.T) {
+	s := runNATSServer(t, -1, false)
+	defer s.Shutdown()
+
+	source := &subscriber.NATS{
+		URL:     s.ClientURL(),
+		Subject: subject,
+		Metrics: newMetrics(t),
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+	waitForState(t, source, subscriber.StateConnected)
+
+	msg := publishNATSUntilReceived(t, s, channel)
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+
+	cancel()
+	waitForState(t, source, subscriber.StateDisconnected)
+}
+
+func TestNATSPlaintextWithTLSConfig(t *testing.T) {
+	s := runNATSServer(t, -1, false)
+	defer s.Shutdown()
+
+	// A TLS configuration shared with the API doesn't make nats:// urls use TLS
+	source := &subscriber.NATS{
+		URL:       s.ClientURL(),
+		Subject:   subject,
+		Metrics:   newMetrics(t),
+		TLSConfig: &tls.Config{},
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+	waitForState(t, source, subscriber.StateConnected)
+
+	msg := publishNATSUntilReceived(t, s, channel)
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
+
+func TestNATSJetStream(t *testing.T) {
+	s := runNATSServer(t, -1, true)
+	defer os.RemoveAll(s.JetStreamConfig().StoreDir)
+	defer s.Shutdown()
+
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     "WIREGUARD",
+		Subjects: []string{subject},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events published before subscribing are delivered by the durable consumer
+	publishNATS(t, s, fixture)
+
+	source := &subscriber.NATS{
+		URL:     s.ClientURL(),
+		Subject: subject,
+		Durable: "relay",
+		Metrics: newMetrics(t),
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+
+	msg := receive(t, channel)
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
+
+func TestNATSUnreachable(t *testing.T) {
+	// Find a free port, and stop the server to make it unreachable
+	s := runNATSServer(t, -1, false)
+	port := s.Addr().(*net.TCPAddr).Port
+	s.Shutdown()
+
+	source := &subscriber.NATS{
+		URL:               s.ClientURL(),
+		Subject:           subject,
+		Metrics:           newMetrics(t),
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Millisecond * 50,
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+
+	if source.State() == subscriber.StateConnected {
+		t.Fatal("connected to unreachable server")
+	}
+
+	s = runNATSServer(t, port, false)
+	defer s.Shutdown()
+
+	waitForState(t, source, subscriber.StateConnected)
+
+	msg := publishNATSUntilReceived(t, s, channel)
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
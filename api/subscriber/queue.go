@@ -0,0 +1,95 @@
+package subscriber
+
+import (
+	"context"
+
+	"github.com/infosum/statsd"
+)
+
+// Queue buffers events between an EventSource and the consumer, without ever blocking the EventSource
+// Once more than the high-water mark of events are queued, the queued events are dropped and a full synchronization is requested instead,
+// since catching up from the API is faster than applying a long backlog of events one by one
+type Queue struct {
+	// C receives the queued events
+	C <-chan WireguardEvent
+
+	// NeedsSync receives a value when events have been dropped, and stays set until it's received
+	NeedsSync <-chan struct{}
+
+	events        chan WireguardEvent
+	needsSync     chan struct{}
+	highWaterMark int
+	metrics       *statsd.Client
+}
+
+// NewQueue returns a Queue holding up to size events, which drops them all once more than highWaterMark are queued
+func NewQueue(size int, highWaterMark int, metrics *statsd.Client) *Queue {
+	if highWaterMark <= 0 || highWaterMark > size {
+		highWaterMark = size
+	}
+
+	events := make(chan WireguardEvent, size)
+	needsSync := make(chan struct{}, 1)
+
+	return &Queue{
+		C:             events,
+		NeedsSync:     needsSync,
+		events:        events,
+		needsSync:     needsSync,
+		highWaterMark: highWaterMark,
+		metrics:       metrics,
+	}
+}
+
+// Forward queues the events received from the channel until the context is canceled
+// The channel is always read from, so it can be passed to EventSource.Subscribe without a buffer
+func (q *Queue) Forward(ctx context.Context, channel <-chan WireguardEvent) {
+	for {
+		select {
+		case event := <-channel:
+			q.Push(event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Push queues an event, or drops the queued events if the queue is past the high-water mark
+func (q *Queue) Push(event WireguardEvent) {
+	if len(q.events) >= q.highWaterMark {
+		q.overflow()
+	}
+
+	select {
+	case q.events <- event:
+	default:
+		// The queue was filled by concurrent pushes, drop this event along with the queued ones
+		q.overflow()
+	}
+}
+
+// Len returns the number of queued events
+func (q *Queue) Len() int {
+	return len(q.events)
+}
+
+// Drop the queued events, and request a full synchronization to pick up the changes they contained
+func (q *Queue) overflow() {
+	// The consumer may be reading concurrently, so don't block if it empties the queue first
+	dropped := 0
+	for len(q.events) > 0 {
+		select {
+		case <-q.events:
+			dropped++
+		default:
+		}
+	}
+
+	q.metrics.Increment("event_queue_overflow")
+	q.metrics.Count("dropped_queued_events", dropped)
+
+	select {
+	case q.needsSync <- struct{}{}:
+	default: // A synchronization is already pending
+	}
+}
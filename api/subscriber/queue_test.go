@@ -0,0 +1,82 @@
+package subscriber_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func TestQueue(t *testing.T) {
+	queue := subscriber.NewQueue(10, 3, newMetrics(t))
+
+	t.Run("queue events", func(t *testing.T) {
+		for i := 1; i <= 3; i++ {
+			queue.Push(subscriber.WireguardEvent{ID: uint64(i)})
+		}
+
+		if queue.Len() != 3 {
+			t.Fatalf("expected 3 queued events, got %d", queue.Len())
+		}
+
+		select {
+		case <-queue.NeedsSync:
+			t.Fatal("synchronization requested before overflowing")
+		default:
+		}
+
+		if event := <-queue.C; event.ID != 1 {
+			t.Fatalf("expected the first event, got %+v", event)
+		}
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		queue.Push(subscriber.WireguardEvent{ID: 4})
+		queue.Push(subscriber.WireguardEvent{ID: 5})
+
+		if queue.Len() != 1 {
+			t.Fatalf("expected the queued events to be dropped, got %d", queue.Len())
+		}
+
+		if event := <-queue.C; event.ID != 5 {
+			t.Fatalf("expected the event after overflowing, got %+v", event)
+		}
+
+		select {
+		case <-queue.NeedsSync:
+		default:
+			t.Fatal("no synchronization requested")
+		}
+
+		select {
+		case <-queue.NeedsSync:
+			t.Fatal("synchronization requested twice")
+		default:
+		}
+	})
+}
+
+func TestQueueForward(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := subscriber.NewQueue(2, 2, newMetrics(t))
+	channel := make(chan subscriber.WireguardEvent)
+	go queue.Forward(ctx, channel)
+
+	// The channel keeps being read even though nothing reads from the queue
+	for i := 0; i < 10; i++ {
+		select {
+		case channel <- subscriber.WireguardEvent{ID: uint64(i)}:
+		case <-time.After(time.Second):
+			t.Fatal("forwarding blocked")
+		}
+	}
+
+	select {
+	case <-queue.NeedsSync:
+	case <-time.After(time.Second):
+		t.Fatal("no synchronization requested")
+	}
+}
@@ -0,0 +1,161 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/infosum/statsd"
+)
+
+// Redis is an EventSource receiving wireguard key events from a Redis Pub/Sub channel
+// Redis doesn't keep messages for disconnected subscribers, so events published while disconnected are lost
+type Redis struct {
+	URL      string
+	Username string
+	Password string
+	Channel  string
+	Metrics  *statsd.Client
+
+	// TLS configuration used for rediss:// urls
+	TLSConfig *tls.Config
+
+	// Reconnection attempts are made with a jittered exponential backoff, starting at MinReconnectDelay and capped at MaxReconnectDelay
+	// The backoff only starts over once a connection has stayed up for MaxReconnectDelay
+	// Defaults to one second and one minute respectively
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	connection
+}
+
+// How long to wait for a message before checking that the connection is still alive
+const redisPingInterval = time.Second * 30
+
+// Subscribe connects to Redis and subscribes to the channel, and emits events on the given channel
+func (r *Redis) Subscribe(ctx context.Context, channel chan<- WireguardEvent) {
+	options, err := redis.ParseURL(r.URL)
+	if err != nil {
+		log.Println("error parsing redis url, real-time events are unavailable", err)
+		r.Metrics.Increment("redis_connect_error")
+		r.setState(StateDisconnected)
+		return
+	}
+
+	if r.Username != "" && r.Password != "" {
+		options.Username = r.Username
+		options.Password = r.Password
+	}
+
+	// Only replace the TLS configuration for rediss:// urls, keeping the server name from the url
+	if options.TLSConfig != nil && r.TLSConfig != nil {
+		tlsConfig := r.TLSConfig.Clone()
+		tlsConfig.ServerName = options.TLSConfig.ServerName
+		options.TLSConfig = tlsConfig
+	}
+
+	go r.run(ctx, redis.NewClient(options), channel)
+}
+
+// Subscribe, and resubscribe with a backoff whenever the subscription fails, until ctx is canceled
+func (r *Redis) run(ctx context.Context, client *redis.Client, channel chan<- WireguardEvent) {
+	defer client.Close()
+
+	for attempt := 0; ; attempt++ {
+		r.setState(StateConnecting)
+
+		connected, err := r.receive(ctx, client, channel)
+		r.setState(StateDisconnected)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			log.Println("error reading from redis, reconnecting", err)
+			r.Metrics.Increment("redis_error")
+
+			if stayedConnected(r.LastConnected(), r.MaxReconnectDelay) {
+				attempt = 0
+			}
+		} else {
+			log.Println("error connecting to redis, real-time events are unavailable until it's reachable", err)
+			r.Metrics.Increment("redis_connect_error")
+		}
+
+		if !sleep(ctx, reconnectDelay(r.MinReconnectDelay, r.MaxReconnectDelay, attempt)) {
+			return
+		}
+	}
+}
+
+// Receive events from a new subscription until it fails, returns whether the subscription was ever established
+func (r *Redis) receive(ctx context.Context, client *redis.Client, channel chan<- WireguardEvent) (bool, error) {
+	pubsub := client.Subscribe(ctx, r.Channel)
+	defer pubsub.Close()
+
+	// Reading isn't interrupted by ctx, so close the subscription to stop it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pubsub.Close()
+		case <-done:
+		}
+	}()
+
+	connected := false
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, redisPingInterval)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// Nothing has been received for a while, make sure the connection is still alive
+			if pinged {
+				return connected, errors.New("no response to ping")
+			}
+
+			pinged = true
+			err = pubsub.Ping(ctx)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return connected, err
+		}
+
+		pinged = false
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				connected = true
+				r.setState(StateConnected)
+			}
+		case *redis.Message:
+			event := WireguardEvent{}
+			err := json.Unmarshal([]byte(m.Payload), &event)
+			if err != nil {
+				log.Println("error decoding event from redis", err)
+				countDecodeError(r.Metrics, "redis", err)
+				continue
+			}
+
+			select {
+			case channel <- event:
+			case <-ctx.Done():
+				return connected, ctx.Err()
+			}
+		}
+	}
+}
+
+func (r *Redis) setState(state State) {
+	r.connection.setState(r.Metrics, "redis", state)
+}
@@ -0,0 +1,129 @@
+package subscriber_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func publishRedis(t *testing.T, m *miniredis.Miniredis, event subscriber.WireguardEvent) {
+	t.Helper()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Publish("wireguard", string(data)) != 1 {
+		t.Fatal("event not delivered to the subscriber")
+	}
+}
+
+func TestRedis(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	source := &subscriber.Redis{
+		URL:               "redis://" + m.Addr(),
+		Channel:           "wireguard",
+		Metrics:           newMetrics(t),
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Millisecond * 50,
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+
+	t.Run("receive event", func(t *testing.T) {
+		waitForState(t, source, subscriber.StateConnected)
+		publishRedis(t, m, fixture)
+
+		msg := receive(t, channel)
+		if !reflect.DeepEqual(msg, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+		}
+	})
+
+	t.Run("invalid event", func(t *testing.T) {
+		m.Publish("wireguard", "invalid")
+		publishRedis(t, m, fixture)
+
+		msg := receive(t, channel)
+		if !reflect.DeepEqual(msg, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		m.Close()
+		waitForState(t, source, subscriber.StateDisconnected)
+
+		err := m.Restart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		waitForState(t, source, subscriber.StateConnected)
+		publishRedis(t, m, fixture)
+
+		msg := receive(t, channel)
+		if !reflect.DeepEqual(msg, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		cancel()
+		waitForState(t, source, subscriber.StateDisconnected)
+	})
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := m.Addr()
+	m.Close()
+
+	source := &subscriber.Redis{
+		URL:               "redis://" + addr,
+		Channel:           "wireguard",
+		Metrics:           newMetrics(t),
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Millisecond * 50,
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+
+	err = m.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	waitForState(t, source, subscriber.StateConnected)
+	publishRedis(t, m, fixture)
+
+	msg := receive(t, channel)
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+}
@@ -0,0 +1,172 @@
+package subscriber
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+)
+
+// Errors returned by Verifier.Verify, for events that should be dropped
+var (
+	ErrUnsigned         = errors.New("event is not signed")
+	ErrInvalidSignature = errors.New("event signature is invalid")
+	ErrExpired          = errors.New("event timestamp is outside of the allowed window")
+	ErrReplayed         = errors.New("event has already been received")
+)
+
+// Prefix of the signed message, to avoid signatures being valid for anything else
+const signingMessageVersion = "wg-manager-event-v1"
+
+// SigningMessage returns the message that is signed for an event
+// It's every field except the signature and the transport ID on a separate line, with lists joined by commas:
+// wg-manager-event-v1, id, action, timestamp, pubkey, ipv4, ipv6, ports, cities
+// The id is the one in the event data, or 0 if it has none, even for server-sent events that have an id field
+// Events without a peer, such as RESYNC, are signed the same way with empty peer fields
+func (e WireguardEvent) SigningMessage() []byte {
+	ports := make([]string, len(e.Peer.Ports))
+	for i, port := range e.Peer.Ports {
+		ports[i] = strconv.Itoa(port)
+	}
+
+	var buf bytes.Buffer
+	for _, field := range []string{
+		signingMessageVersion,
+		strconv.FormatUint(e.ID, 10),
+		string(e.Action),
+		strconv.FormatInt(e.Timestamp, 10),
+		e.Peer.Pubkey,
+		e.Peer.IPv4,
+		e.Peer.IPv6,
+		strings.Join(ports, ","),
+		strings.Join(e.Peer.Cities, ","),
+	} {
+		buf.WriteString(field)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes()
+}
+
+// Sign sets the signature of the event using the given private key
+func (e *WireguardEvent) Sign(key ed25519.PrivateKey) {
+	e.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, e.SigningMessage()))
+}
+
+// Verifier verifies that events are signed by one of a set of Ed25519 public keys, and aren't replayed
+// Keys can be rotated by trusting both the old and the new key until every publisher uses the new one
+type Verifier struct {
+	keys    []ed25519.PublicKey
+	maxAge  time.Duration
+	metrics *statsd.Client
+
+	// Signatures of the events received within the allowed window, to drop events that are sent again
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewVerifier returns a Verifier trusting the given base64 encoded public keys
+// Events with a timestamp more than maxAge away from the current time are rejected
+func NewVerifier(keys []string, maxAge time.Duration, metrics *statsd.Client) (*Verifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no public keys configured")
+	}
+
+	v := &Verifier{
+		maxAge:  maxAge,
+		metrics: metrics,
+		seen:    make(map[string]time.Time),
+	}
+
+	for _, key := range keys {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key %s", key)
+		}
+
+		v.keys = append(v.keys, ed25519.PublicKey(decoded))
+	}
+
+	return v, nil
+}
+
+// Verify returns an error if the event isn't signed by a trusted key, is too old or has already been received
+func (v *Verifier) Verify(event WireguardEvent) error {
+	err := v.verify(event, time.Now())
+	switch err {
+	case nil:
+	case ErrUnsigned:
+		v.metrics.Increment("event_unsigned")
+	case ErrInvalidSignature:
+		v.metrics.Increment("event_invalid_signature")
+	case ErrExpired:
+		v.metrics.Increment("event_expired")
+	case ErrReplayed:
+		v.metrics.Increment("event_replayed")
+	}
+
+	return err
+}
+
+func (v *Verifier) verify(event WireguardEvent, now time.Time) error {
+	if event.Signature == "" {
+		return ErrUnsigned
+	}
+
+	// Decode strictly, the lenient decoder accepts several encodings of the same signature
+	signature, err := base64.StdEncoding.Strict().DecodeString(event.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+
+	message := event.SigningMessage()
+	valid := false
+	for _, key := range v.keys {
+		if ed25519.Verify(key, message, signature) {
+			valid = true
+			break
+		}
+	}
+
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	// Allow for clock skew in both directions
+	timestamp := time.Unix(event.Timestamp, 0)
+	if timestamp.Before(now.Add(-v.maxAge)) || timestamp.After(now.Add(v.maxAge)) {
+		return ErrExpired
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Events outside of the window are rejected above, so their signatures don't need to be kept
+	if now.Sub(v.lastPrune) > v.maxAge {
+		for s, t := range v.seen {
+			if t.Before(now.Add(-v.maxAge)) {
+				delete(v.seen, s)
+			}
+		}
+
+		v.lastPrune = now
+	}
+
+	// Key on the decoded signature, so that an event can't be replayed by encoding its signature differently
+	key := string(signature)
+	if _, ok := v.seen[key]; ok {
+		return ErrReplayed
+	}
+
+	v.seen[key] = timestamp
+
+	return nil
+}
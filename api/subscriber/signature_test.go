@@ -0,0 +1,138 @@
+package subscriber_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func newSigningKey(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(public), private
+}
+
+func signedFixture(key ed25519.PrivateKey, timestamp time.Time) subscriber.WireguardEvent {
+	event := fixture
+	event.Timestamp = timestamp.Unix()
+	event.Sign(key)
+
+	return event
+}
+
+func TestVerifier(t *testing.T) {
+	oldPublic, oldPrivate := newSigningKey(t)
+	newPublic, newPrivate := newSigningKey(t)
+	_, untrustedPrivate := newSigningKey(t)
+
+	verifier, err := subscriber.NewVerifier([]string{oldPublic, newPublic}, time.Minute, newMetrics(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := signedFixture(newPrivate, time.Now())
+	tampered.Peer.IPv4 = "10.99.0.2/32"
+
+	// Events without a peer must be signed as well
+	resync := subscriber.WireguardEvent{ID: 42, Action: subscriber.ActionResync, Timestamp: time.Now().Unix()}
+	signedResync := resync
+	signedResync.Sign(newPrivate)
+
+	invalidSignature := fixture
+	invalidSignature.Timestamp = time.Now().Unix()
+	invalidSignature.Signature = "invalid"
+
+	tests := []struct {
+		name  string
+		event subscriber.WireguardEvent
+		err   error
+	}{
+		{"old key", signedFixture(oldPrivate, time.Now()), nil},
+		{"new key", signedFixture(newPrivate, time.Now().Add(time.Second)), nil},
+		{"clock skew", signedFixture(newPrivate, time.Now().Add(time.Second*30)), nil},
+		{"signed resync", signedResync, nil},
+		{"unsigned", fixture, subscriber.ErrUnsigned},
+		{"unsigned resync", resync, subscriber.ErrUnsigned},
+		{"invalid signature", invalidSignature, subscriber.ErrInvalidSignature},
+		{"untrusted key", signedFixture(untrustedPrivate, time.Now()), subscriber.ErrInvalidSignature},
+		{"tampered", tampered, subscriber.ErrInvalidSignature},
+		{"too old", signedFixture(newPrivate, time.Now().Add(-time.Minute*2)), subscriber.ErrExpired},
+		{"too new", signedFixture(newPrivate, time.Now().Add(time.Minute*2)), subscriber.ErrExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifier.Verify(test.event)
+			if err != test.err {
+				t.Fatalf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	t.Run("replayed", func(t *testing.T) {
+		event := signedFixture(newPrivate, time.Now().Add(-time.Second))
+
+		err := verifier.Verify(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = verifier.Verify(event)
+		if err != subscriber.ErrReplayed {
+			t.Fatalf("expected %v, got %v", subscriber.ErrReplayed, err)
+		}
+	})
+
+	t.Run("replayed with a re-encoded signature", func(t *testing.T) {
+		event := signedFixture(newPrivate, time.Now().Add(-time.Second*2))
+
+		err := verifier.Verify(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Line breaks are ignored when decoding
+		withLineBreaks := event
+		withLineBreaks.Signature = event.Signature[:44] + "\r\n" + event.Signature[44:]
+
+		err = verifier.Verify(withLineBreaks)
+		if err != subscriber.ErrReplayed {
+			t.Fatalf("expected %v, got %v", subscriber.ErrReplayed, err)
+		}
+
+		// The last character before the padding has unused bits, which the lenient decoder ignores
+		signature := []byte(event.Signature)
+		signature[len(signature)-3] = base64Alphabet[strings.IndexByte(base64Alphabet, signature[len(signature)-3])|1]
+		withPaddingBits := event
+		withPaddingBits.Signature = string(signature)
+
+		err = verifier.Verify(withPaddingBits)
+		if err != subscriber.ErrInvalidSignature {
+			t.Fatalf("expected %v, got %v", subscriber.ErrInvalidSignature, err)
+		}
+	})
+}
+
+const base64Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+func TestNewVerifier(t *testing.T) {
+	_, err := subscriber.NewVerifier([]string{}, time.Minute, newMetrics(t))
+	if err == nil {
+		t.Fatal("no error without keys")
+	}
+
+	_, err = subscriber.NewVerifier([]string{base64.StdEncoding.EncodeToString([]byte("short"))}, time.Minute, newMetrics(t))
+	if err == nil {
+		t.Fatal("no error for invalid key")
+	}
+}
@@ -0,0 +1,306 @@
+package subscriber
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+)
+
+// SSE is an EventSource receiving wireguard key events as server-sent events, for networks where websockets don't work
+// Requests are made with the HTTP client, credentials and TLS configuration of the API
+// When reconnecting, the ID of the last event received is sent in the Last-Event-ID header, so that the server can replay the events that were missed
+type SSE struct {
+	URL     string
+	API     *api.API
+	Metrics *statsd.Client
+
+	// Reconnection attempts are made with a jittered exponential backoff, starting at MinReconnectDelay and capped at MaxReconnectDelay
+	// The backoff only starts over once a connection has stayed up for MaxReconnectDelay
+	// Defaults to one second and one minute respectively, the server can override MinReconnectDelay with the retry field
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// The connection is reestablished if nothing, not even a keep-alive comment, is received for IdleTimeout,
+	// so that a connection that was silently dropped, e.g. by a proxy, doesn't go unnoticed. Defaults to two minutes
+	IdleTimeout time.Duration
+
+	connection
+
+	mu          sync.Mutex
+	lastEventID string
+	retry       time.Duration
+}
+
+// Header containing the ID of the last event received
+const lastEventIDHeader = "Last-Event-ID"
+
+// How much of the response body to include in errors
+const maxErrorBodyLength = 512
+
+const defaultIdleTimeout = time.Minute * 2
+
+// Subscribe connects to the event stream, and emits events on the given channel
+func (s *SSE) Subscribe(ctx context.Context, channel chan<- WireguardEvent) {
+	body, err := s.connect(ctx)
+	if err != nil {
+		log.Println("error connecting to event stream, real-time events are unavailable until it's reachable", err)
+		s.Metrics.Increment("sse_connect_error")
+	}
+
+	go s.run(ctx, channel, body)
+}
+
+// LastEventID returns the ID of the last event received, or an empty string if no event with an ID has been received
+func (s *SSE) LastEventID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastEventID
+}
+
+func (s *SSE) setState(state State) {
+	s.connection.setState(s.Metrics, "sse", state)
+}
+
+func (s *SSE) connect(ctx context.Context) (io.ReadCloser, error) {
+	s.setState(StateConnecting)
+
+	body, err := s.request(ctx)
+	if err != nil {
+		s.setState(StateDisconnected)
+		return nil, err
+	}
+
+	s.setState(StateConnected)
+
+	return body, nil
+}
+
+func (s *SSE) request(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if lastEventID := s.LastEventID(); lastEventID != "" {
+		req.Header.Set(lastEventIDHeader, lastEventID)
+	}
+
+	s.API.Authorize(req)
+
+	// The API client has a timeout for the whole request, which would end the stream, so only its transport is used
+	client := &http.Client{}
+	if s.API.Client != nil {
+		client.Transport = s.API.Client.Transport
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		excerpt, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBodyLength))
+
+		return nil, &api.StatusError{
+			StatusCode: response.StatusCode,
+			Body:       string(excerpt),
+		}
+	}
+
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/event-stream" {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected content type %s", response.Header.Get("Content-Type"))
+	}
+
+	return response.Body, nil
+}
+
+// Read from the stream, and reconnect whenever it's lost, until ctx is canceled
+// If body is nil, a connection is established first
+func (s *SSE) run(ctx context.Context, channel chan<- WireguardEvent, body io.ReadCloser) {
+	attempt := 0
+	for {
+		if body != nil {
+			err := s.read(ctx, channel, body)
+			body.Close()
+			s.setState(StateDisconnected)
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Println("error reading from event stream, reconnecting", err)
+			s.Metrics.Increment("sse_error")
+			attempt++
+			if stayedConnected(s.LastConnected(), s.MaxReconnectDelay) {
+				attempt = 0
+			}
+		}
+
+		body, attempt = s.reconnect(ctx, attempt)
+		if body == nil {
+			return
+		}
+	}
+}
+
+// Attempt to reconnect with a backoff continuing from the given attempt, returns nil if ctx is canceled before a connection is established
+// The attempt the connection was established at is returned along with it
+func (s *SSE) reconnect(ctx context.Context, attempt int) (io.ReadCloser, int) {
+	for ; ; attempt++ {
+		minDelay := s.MinReconnectDelay
+		s.mu.Lock()
+		if s.retry > 0 {
+			minDelay = s.retry
+		}
+		s.mu.Unlock()
+
+		if !sleep(ctx, reconnectDelay(minDelay, s.MaxReconnectDelay, attempt)) {
+			return nil, attempt
+		}
+
+		body, err := s.connect(ctx)
+		if err != nil && ctx.Err() != nil {
+			return nil, attempt
+		}
+		if err != nil {
+			log.Println("error reconnecting to event stream", err)
+			s.Metrics.Increment("sse_reconnect_error")
+			continue
+		}
+
+		log.Println("successfully reconnected to event stream")
+		s.Metrics.Increment("sse_reconnect_success")
+
+		return body, attempt
+	}
+}
+
+// Read events from the stream until it ends, as described in https://html.spec.whatwg.org/multipage/server-sent-events.html
+// The body is closed if nothing is received for the idle timeout, which ends the stream
+func (s *SSE) read(ctx context.Context, channel chan<- WireguardEvent, body io.ReadCloser) error {
+	reader := bufio.NewReader(body)
+
+	idleTimeout := s.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	idle := time.AfterFunc(idleTimeout, func() {
+		body.Close()
+	})
+	defer idle.Stop()
+
+	var data bytes.Buffer
+	var id string
+	hasID := false
+
+	for {
+		idle.Reset(idleTimeout)
+		line, err := reader.ReadBytes('\n')
+		if !idle.Stop() {
+			s.Metrics.Increment("sse_idle_timeout")
+			return fmt.Errorf("nothing received from event stream for %s", idleTimeout)
+		}
+		if err == io.EOF {
+			// The last event is only dispatched if it's terminated by a blank line
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		line = bytes.TrimRight(line, "\r\n")
+
+		// A blank line dispatches the event
+		if len(line) == 0 {
+			if hasID {
+				s.mu.Lock()
+				s.lastEventID = id
+				s.mu.Unlock()
+			}
+
+			if data.Len() > 0 {
+				event, err := decodeEvent(data.Bytes(), s.LastEventID())
+				if err != nil {
+					log.Println("error decoding event from event stream", err)
+					countDecodeError(s.Metrics, "sse", err)
+				} else {
+					if event.Action == ActionResync {
+						log.Println("event stream can't replay missed events, requesting a full synchronization")
+						s.Metrics.Increment("sse_resync")
+					}
+
+					select {
+					case channel <- event:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}
+
+			data.Reset()
+			hasID = false
+			continue
+		}
+
+		// Lines starting with a colon are comments, used as keep-alives
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, []byte{}
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], bytes.TrimPrefix(line[i+1:], []byte(" "))
+		}
+
+		switch string(field) {
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.Write(value)
+		case "id":
+			id = string(value)
+			hasID = true
+		case "retry":
+			if milliseconds, err := strconv.Atoi(string(value)); err == nil && milliseconds > 0 {
+				s.mu.Lock()
+				s.retry = time.Duration(milliseconds) * time.Millisecond
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// Decode the data of an event, with the SSE event ID as its transport ID
+// The ID in the data is left as the publisher set it, as it's part of the signed message
+func decodeEvent(data []byte, lastEventID string) (WireguardEvent, error) {
+	event := WireguardEvent{}
+	err := json.Unmarshal(data, &event)
+	if err != nil {
+		return WireguardEvent{}, err
+	}
+
+	event.TransportID = lastEventID
+
+	return event, nil
+}
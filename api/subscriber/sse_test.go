@@ -0,0 +1,264 @@
+package subscriber_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+func TestSSE(t *testing.T) {
+	lastEventIDs := make(chan string, 2)
+	connections := 0
+
+	data, err := json.Marshal(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || u != username || p != password || r.Header.Get("X-Relay-Hostname") != "relay" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path != "/channel/test" || r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		connections++
+		if connections > 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		lastEventIDs <- r.Header.Get("Last-Event-ID")
+
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		// Send an event on the first connection, and tell the subscriber to resynchronize on the second
+		if connections == 1 {
+			fmt.Fprintf(w, "retry: 10\n: keep-alive\n\nid: 41\ndata: %s\n\n", data)
+		} else {
+			fmt.Fprintf(w, "data: invalid\n\nid: 42\ndata: {\"action\":\n")
+			fmt.Fprintf(w, "data: \"RESYNC\"}\n\n")
+		}
+
+		w.(http.Flusher).Flush()
+	}))
+	defer server.Close()
+
+	source, err := subscriber.New(subscriber.Config{
+		URL:     server.URL,
+		Channel: "test",
+		Metrics: newMetrics(t),
+		API: &api.API{
+			Username: username,
+			Password: password,
+			Hostname: "relay",
+			Client:   server.Client(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+
+	// The SSE event ID is kept apart from the ID in the event data
+	expected := fixture
+	expected.TransportID = "41"
+
+	msg := receive(t, channel)
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", expected, msg)
+	}
+
+	msg = receive(t, channel)
+	if msg.ID != 0 || msg.TransportID != "42" || msg.Action != subscriber.ActionResync {
+		t.Fatalf("unexpected event %+v", msg)
+	}
+
+	if id := <-lastEventIDs; id != "" {
+		t.Errorf("unexpected last event id on the first connection %s", id)
+	}
+
+	if id := <-lastEventIDs; id != "41" {
+		t.Errorf("unexpected last event id on reconnect %s", id)
+	}
+
+	if id := source.(*subscriber.SSE).LastEventID(); id != "42" {
+		t.Errorf("unexpected last event id %s", id)
+	}
+}
+
+func TestSSESigned(t *testing.T) {
+	public, private := newSigningKey(t)
+
+	// The publisher signs the event without an ID, and the stream delivers it with one
+	data, err := json.Marshal(signedFixture(private, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "id: 7\ndata: %s\n\n", data)
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	source := &subscriber.SSE{
+		URL:     server.URL,
+		API:     &api.API{},
+		Metrics: newMetrics(t),
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, channel)
+
+	verifier, err := subscriber.NewVerifier([]string{public}, time.Minute, newMetrics(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, channel)
+	if msg.TransportID != "7" {
+		t.Fatalf("unexpected transport id %s", msg.TransportID)
+	}
+
+	if err := verifier.Verify(msg); err != nil {
+		t.Fatalf("the signature of an event received over server-sent events didn't verify: %s", err)
+	}
+}
+
+func TestSSEBackoff(t *testing.T) {
+	var connections int32
+
+	// Accept every connection, and end the stream right away
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	source := &subscriber.SSE{
+		URL:               server.URL,
+		API:               &api.API{},
+		Metrics:           newMetrics(t),
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Second * 10,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, make(chan subscriber.WireguardEvent, 1024))
+
+	// The delay keeps doubling, as the connections don't stay up long enough for the backoff to start over
+	time.Sleep(time.Millisecond * 500)
+	if n := atomic.LoadInt32(&connections); n > 8 {
+		t.Fatalf("reconnected %d times to an event stream ending every connection", n)
+	}
+}
+
+func TestSSEIdleTimeout(t *testing.T) {
+	var connections int32
+
+	// Send keep-alives on the first connection for a while, and then stop sending anything without closing it
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&connections, 1)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		if n == 1 {
+			for i := 0; i < 10; i++ {
+				time.Sleep(time.Millisecond * 20)
+				fmt.Fprintf(w, ": keep-alive\n")
+				w.(http.Flusher).Flush()
+			}
+		}
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	source := &subscriber.SSE{
+		URL:               server.URL,
+		API:               &api.API{},
+		Metrics:           newMetrics(t),
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Millisecond * 10,
+		IdleTimeout:       time.Millisecond * 100,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, make(chan subscriber.WireguardEvent, 1024))
+
+	// The keep-alives keep the connection open for longer than the idle timeout
+	time.Sleep(time.Millisecond * 150)
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("reconnected while receiving keep-alives, %d connections", n)
+	}
+
+	// Once nothing is received anymore, the connection is reestablished
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&connections) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle connection wasn't reestablished")
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSSEUnexpectedContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+	}))
+	defer server.Close()
+
+	source := &subscriber.SSE{
+		URL:     server.URL,
+		API:     &api.API{},
+		Metrics: newMetrics(t),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source.Subscribe(ctx, make(chan subscriber.WireguardEvent))
+
+	if source.State() != subscriber.StateDisconnected {
+		t.Fatalf("unexpected state %s", source.State())
+	}
+}
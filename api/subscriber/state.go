@@ -0,0 +1,132 @@
+package subscriber
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/infosum/statsd"
+)
+
+// State is the state of the connection to the message-queue
+type State int
+
+// The states a Subscriber moves between
+// A Subscriber starts out disconnected, is connecting while dialing the message-queue, and is disconnected again while waiting to retry
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	defaultMinReconnectDelay = time.Second
+	defaultMaxReconnectDelay = time.Minute
+)
+
+// Keeps track of the state of a connection to the message-queue, embedded in each EventSource
+type connection struct {
+	mu            sync.Mutex
+	state         State
+	lastConnected time.Time
+}
+
+// State returns the current state of the connection to the message-queue
+func (c *connection) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+// LastConnected returns when the connection to the message-queue was last established, or the zero time if it never was
+func (c *connection) LastConnected() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastConnected
+}
+
+// Update the state, and report it as metrics prefixed with the name of the event source
+func (c *connection) setState(metrics *statsd.Client, prefix string, state State) {
+	c.mu.Lock()
+	changed := c.state != state
+	c.state = state
+	if state == StateConnected {
+		c.lastConnected = time.Now()
+	}
+	c.mu.Unlock()
+
+	if changed {
+		metrics.Increment(prefix + "_state_" + state.String())
+	}
+
+	// Real-time events are only available while connected, otherwise we rely on synchronization
+	if state == StateConnected {
+		metrics.Gauge(prefix+"_connected", 1)
+	} else {
+		metrics.Gauge(prefix+"_connected", 0)
+	}
+}
+
+// Calculate the delay before the given reconnection attempt, with jitter so that relays don't reconnect in lockstep
+// Zero values for minDelay and maxDelay are replaced by the defaults
+func reconnectDelay(minDelay time.Duration, maxDelay time.Duration, attempt int) time.Duration {
+	if minDelay <= 0 {
+		minDelay = defaultMinReconnectDelay
+	}
+
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+
+	delay := minDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// Use a random delay between half and the full delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Return whether a connection established at connected stayed up long enough for the reconnection backoff to start over
+// Otherwise the backoff continues, so that a message-queue that drops connections right after accepting them
+// isn't hit by every relay at the min delay
+func stayedConnected(connected time.Time, maxDelay time.Duration) bool {
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+
+	return time.Since(connected) >= maxDelay
+}
+
+// Sleep for the given duration, returns false if ctx is canceled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
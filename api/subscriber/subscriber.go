@@ -3,97 +3,182 @@ package subscriber
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/infosum/statsd"
-	"github.com/mullvad/wg-manager/api"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 )
 
-// Subscriber is a utility for receiving wireguard key events from a message-queue server
+// Subscriber is an EventSource receiving wireguard key events from a message-queue server over a websocket
+// When reconnecting, the ID of the last event received is sent in the Last-Event-ID header, so that the server can replay the events that were missed
 type Subscriber struct {
 	Username string
 	Password string
 	BaseURL  string
 	Channel  string
 	Metrics  *statsd.Client
-}
 
-// WireguardEvent is a wireguard key event
-type WireguardEvent struct {
-	Action string            `json:"action"`
-	Peer   api.WireguardPeer `json:"peer"`
+	// Client used to dial the websocket, for example to configure TLS. http.DefaultClient is used if nil
+	HTTPClient *http.Client
+
+	// Reconnection attempts are made with a jittered exponential backoff, starting at MinReconnectDelay and capped at MaxReconnectDelay
+	// The backoff only starts over once a connection has stayed up for MaxReconnectDelay
+	// Defaults to one second and one minute respectively
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	connection
+
+	mu          sync.Mutex
+	lastEventID uint64
 }
 
 const subProtocol = "message-queue-v1"
 
 // Subscribe establishes a websocket connection for a message-queue channel, and emits messages on the given channel
-func (s *Subscriber) Subscribe(ctx context.Context, channel chan<- WireguardEvent) error {
-	err := s.connect(ctx, channel)
-
+// If the message-queue is unreachable, or the connection is lost, it's reestablished in the background until ctx is canceled
+func (s *Subscriber) Subscribe(ctx context.Context, channel chan<- WireguardEvent) {
+	conn, err := s.connect(ctx)
 	if err != nil {
-		return err
+		log.Println("error connecting to websocket, real-time events are unavailable until it's reachable", err)
+		s.Metrics.Increment("websocket_connect_error")
 	}
 
-	return nil
+	go s.run(ctx, channel, conn)
 }
 
-func (s *Subscriber) connect(ctx context.Context, channel chan<- WireguardEvent) error {
+// LastEventID returns the ID of the last event received, or 0 if no event with an ID has been received
+func (s *Subscriber) LastEventID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastEventID
+}
+
+func (s *Subscriber) setState(state State) {
+	s.connection.setState(s.Metrics, "websocket", state)
+}
+
+func (s *Subscriber) connect(ctx context.Context) (*websocket.Conn, error) {
+	s.setState(StateConnecting)
+
 	header := http.Header{}
 
 	if s.Username != "" && s.Password != "" {
 		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password)))
 	}
 
+	if lastEventID := s.LastEventID(); lastEventID != 0 {
+		header.Set(lastEventIDHeader, strconv.FormatUint(lastEventID, 10))
+	}
+
 	conn, _, err := websocket.Dial(ctx, s.BaseURL+"/channel/"+s.Channel, &websocket.DialOptions{
 		Subprotocols: []string{subProtocol},
 		HTTPHeader:   header,
+		HTTPClient:   s.HTTPClient,
 	})
 
 	if err != nil {
-		return err
+		s.setState(StateDisconnected)
+		return nil, err
 	}
 
-	go s.read(ctx, channel, conn)
+	s.setState(StateConnected)
+
+	return conn, nil
+}
+
+// Read from the connection, and reconnect whenever it's lost, until ctx is canceled
+// If conn is nil, a connection is established first
+func (s *Subscriber) run(ctx context.Context, channel chan<- WireguardEvent, conn *websocket.Conn) {
+	attempt := 0
+	for {
+		if conn != nil {
+			s.read(ctx, channel, conn)
+			s.setState(StateDisconnected)
+			attempt++
+			if stayedConnected(s.LastConnected(), s.MaxReconnectDelay) {
+				attempt = 0
+			}
+		}
 
-	return nil
+		conn, attempt = s.reconnect(ctx, attempt)
+		if conn == nil {
+			return
+		}
+	}
 }
 
+// Read events from the connection until it fails
 func (s *Subscriber) read(ctx context.Context, channel chan<- WireguardEvent, conn *websocket.Conn) {
+	// Make sure the connection is closed
+	defer conn.Close(websocket.StatusInternalError, "")
+
 	for {
-		v := WireguardEvent{}
-		err := wsjson.Read(ctx, conn, &v)
+		_, data, err := conn.Read(ctx)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			log.Println("error reading from websocket, reconnecting", err)
 			s.Metrics.Increment("websocket_error")
+			return
+		}
+
+		// Decode the message separately from reading it, so that an invalid event doesn't close the connection
+		v := WireguardEvent{}
+		err = json.Unmarshal(data, &v)
+		if err != nil {
+			log.Println("error decoding event from websocket", err)
+			countDecodeError(s.Metrics, "websocket", err)
+			continue
+		}
 
-			// Make sure the connection is closed
-			conn.Close(websocket.StatusInternalError, "")
+		if v.ID != 0 {
+			s.mu.Lock()
+			s.lastEventID = v.ID
+			s.mu.Unlock()
+		}
 
-			// Start attempting to reconnect
-			go s.reconnect(ctx, channel)
+		if v.Action == ActionResync {
+			log.Println("message-queue can't replay missed events, requesting a full synchronization")
+			s.Metrics.Increment("websocket_resync")
+		}
 
+		select {
+		case channel <- v:
+		case <-ctx.Done():
 			return
 		}
-
-		channel <- v
 	}
 }
 
-func (s *Subscriber) reconnect(ctx context.Context, channel chan<- WireguardEvent) {
-	// Sleep
-	time.Sleep(time.Second)
+// Attempt to reconnect with a backoff continuing from the given attempt, returns nil if ctx is canceled before a connection is established
+// The attempt the connection was established at is returned along with it
+func (s *Subscriber) reconnect(ctx context.Context, attempt int) (*websocket.Conn, int) {
+	for ; ; attempt++ {
+		if !sleep(ctx, reconnectDelay(s.MinReconnectDelay, s.MaxReconnectDelay, attempt)) {
+			return nil, attempt
+		}
+
+		conn, err := s.connect(ctx)
+		if err != nil && ctx.Err() != nil {
+			return nil, attempt
+		}
+		if err != nil {
+			log.Println("error reconnecting to websocket", err)
+			s.Metrics.Increment("websocket_reconnect_error")
+			continue
+		}
 
-	// Attempt to create a new connection
-	err := s.connect(ctx, channel)
-	if err != nil {
-		s.Metrics.Increment("websocket_reconnect_error")
-		go s.reconnect(ctx, channel)
-	} else {
 		log.Println("successfully reconnected to websocket")
 		s.Metrics.Increment("websocket_reconnect_success")
+
+		return conn, attempt
 	}
 }
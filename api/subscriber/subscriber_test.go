@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -80,10 +81,7 @@ func TestSubscriber(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	err = s.Subscribe(ctx, channel)
-	if err != nil {
-		t.Fatal(err)
-	}
+	s.Subscribe(ctx, channel)
 
 	// Try to recieve two messages
 	// This will also test the reconnection logic, as the mock server closes the connection after sending the message
@@ -94,3 +92,328 @@ func TestSubscriber(t *testing.T) {
 		}
 	}
 }
+
+func TestSubscriberResume(t *testing.T) {
+	lastEventIDs := make(chan string, 2)
+	connections := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connections++
+		if connections > 2 {
+			return
+		}
+
+		lastEventIDs <- r.Header.Get("Last-Event-ID")
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		// Send an event on the first connection, and tell the subscriber to resynchronize on the second
+		event := fixture
+		event.ID = 41
+		if connections > 1 {
+			event = subscriber.WireguardEvent{ID: 42, Action: subscriber.ActionResync}
+		}
+
+		err = wsjson.Write(ctx, c, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL: "ws://" + parsedURL.Host,
+		Channel: "test",
+		Metrics: metrics,
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Subscribe(ctx, channel)
+
+	msg := <-channel
+	if msg.ID != 41 || msg.Action != fixture.Action {
+		t.Fatalf("unexpected event %+v", msg)
+	}
+
+	msg = <-channel
+	if msg.ID != 42 || msg.Action != subscriber.ActionResync {
+		t.Fatalf("unexpected event %+v", msg)
+	}
+
+	if id := <-lastEventIDs; id != "" {
+		t.Errorf("unexpected last event id on the first connection %s", id)
+	}
+
+	if id := <-lastEventIDs; id != "41" {
+		t.Errorf("unexpected last event id on reconnect %s", id)
+	}
+
+	if s.LastEventID() != 42 {
+		t.Errorf("unexpected last event id %d", s.LastEventID())
+	}
+}
+
+func TestSubscriberState(t *testing.T) {
+	var attempts int32
+	closeConnection := make(chan struct{})
+
+	// Accept the first connection until told to close it, and reject every attempt to reconnect
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) > 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		<-closeConnection
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:           "ws://" + parsedURL.Host,
+		Channel:           "test",
+		Metrics:           metrics,
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Millisecond * 40,
+	}
+
+	if s.State() != subscriber.StateDisconnected || !s.LastConnected().IsZero() {
+		t.Fatalf("unexpected initial state %s", s.State())
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Subscribe(ctx, channel)
+
+	if s.State() != subscriber.StateConnected || s.LastConnected().IsZero() {
+		t.Fatalf("unexpected state after subscribing %s", s.State())
+	}
+
+	close(closeConnection)
+
+	// Wait for a few failed reconnection attempts
+	for atomic.LoadInt32(&attempts) < 4 {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if s.State() == subscriber.StateConnected {
+		t.Fatal("connected while the server is rejecting connections")
+	}
+
+	// No more attempts should be made once canceled
+	cancel()
+	time.Sleep(time.Millisecond * 50)
+	canceledAttempts := atomic.LoadInt32(&attempts)
+	time.Sleep(time.Millisecond * 100)
+
+	if atomic.LoadInt32(&attempts) != canceledAttempts {
+		t.Fatal("reconnection attempts made after cancellation")
+	}
+
+	if s.State() != subscriber.StateDisconnected {
+		t.Fatalf("unexpected state after cancellation %s", s.State())
+	}
+}
+
+func TestSubscriberBackoff(t *testing.T) {
+	var connections int32
+
+	// Accept every connection, and drop it right away
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:           "ws://" + parsedURL.Host,
+		Channel:           "test",
+		Metrics:           newMetrics(t),
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Second * 10,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Subscribe(ctx, make(chan subscriber.WireguardEvent, 1024))
+
+	// The delay keeps doubling, as the connections don't stay up long enough for the backoff to start over
+	time.Sleep(time.Millisecond * 500)
+	if n := atomic.LoadInt32(&connections); n > 8 {
+		t.Fatalf("reconnected %d times to a message-queue dropping every connection", n)
+	}
+}
+
+func TestSubscriberUnreachable(t *testing.T) {
+	var attempts int32
+
+	// Reject the first connections, as if the message-queue was down on startup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		err = wsjson.Write(ctx, c, fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := statsd.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL:           "ws://" + parsedURL.Host,
+		Channel:           "test",
+		Metrics:           metrics,
+		MinReconnectDelay: time.Millisecond * 10,
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Subscribe(ctx, channel)
+
+	if s.State() != subscriber.StateDisconnected {
+		t.Fatalf("unexpected state after failing to connect %s", s.State())
+	}
+
+	select {
+	case msg := <-channel:
+		if !reflect.DeepEqual(msg, fixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no event received after the message-queue became reachable")
+	}
+}
+
+func TestSubscriberInvalidEvent(t *testing.T) {
+	var connections int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&connections, 1)
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second*10)
+		defer cancel()
+
+		err = c.Write(ctx, websocket.MessageText, []byte(`{"action":"UNKNOWN","peer":{}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The connection is still open, so the next event is received on it
+		err = wsjson.Write(ctx, c, fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		<-ctx.Done()
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := subscriber.Subscriber{
+		BaseURL: "ws://" + parsedURL.Host,
+		Channel: "test",
+		Metrics: newMetrics(t),
+	}
+
+	channel := make(chan subscriber.WireguardEvent, 1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Subscribe(ctx, channel)
+
+	msg := receive(t, channel)
+	if !reflect.DeepEqual(msg, fixture) {
+		t.Errorf("got unexpected result, wanted %+v, got %+v", fixture, msg)
+	}
+
+	if n := atomic.LoadInt32(&connections); n != 1 {
+		t.Fatalf("expected one connection, got %d", n)
+	}
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// The reasons a peer can be rejected for, used in metrics
+const (
+	ReasonInvalidPubkey       = "invalid_pubkey"
+	ReasonInvalidIPv4         = "invalid_ipv4"
+	ReasonInvalidIPv6         = "invalid_ipv6"
+	ReasonInvalidPort         = "invalid_port"
+	ReasonCitiesPortsMismatch = "cities_ports_mismatch"
+)
+
+// Length of a decoded wireguard public key
+const pubkeyLength = 32
+
+// ValidationError is returned for a peer that can't be applied, with the reason it was rejected
+type ValidationError struct {
+	Reason  string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+}
+
+// Validate returns a *ValidationError if the peer can't be applied as is
+// The public key must be a base64 encoded 32 byte key, the addresses single hosts in CIDR notation,
+// the ports within 1-65535 and the cities, if any, one per port
+func (p WireguardPeer) Validate() error {
+	key, err := base64.StdEncoding.DecodeString(p.Pubkey)
+	if err != nil || len(key) != pubkeyLength {
+		return &ValidationError{Reason: ReasonInvalidPubkey, Message: fmt.Sprintf("invalid public key %q", p.Pubkey)}
+	}
+
+	if !validHostAddress(p.IPv4, net.IPv4len) {
+		return &ValidationError{Reason: ReasonInvalidIPv4, Message: fmt.Sprintf("invalid ipv4 address %q for %s", p.IPv4, p.Pubkey)}
+	}
+
+	if !validHostAddress(p.IPv6, net.IPv6len) {
+		return &ValidationError{Reason: ReasonInvalidIPv6, Message: fmt.Sprintf("invalid ipv6 address %q for %s", p.IPv6, p.Pubkey)}
+	}
+
+	for _, port := range p.Ports {
+		if port < 1 || port > 65535 {
+			return &ValidationError{Reason: ReasonInvalidPort, Message: fmt.Sprintf("invalid port %d for %s", port, p.Pubkey)}
+		}
+	}
+
+	// Cities are optional, but if present there's one for every port
+	if len(p.Cities) > 0 && len(p.Cities) != len(p.Ports) {
+		return &ValidationError{Reason: ReasonCitiesPortsMismatch, Message: fmt.Sprintf("%d cities for %d ports for %s", len(p.Cities), len(p.Ports), p.Pubkey)}
+	}
+
+	return nil
+}
+
+// Whether the address is a single host of the given length, e.g. 10.99.0.1/32
+func validHostAddress(address string, length int) bool {
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return false
+	}
+
+	if length == net.IPv4len && ip.To4() == nil || length == net.IPv6len && ip.To4() != nil {
+		return false
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	return ones == bits && bits == length*8
+}
+
+// PeerRejection is a peer that was rejected by validation, and the reason it was rejected for
+type PeerRejection struct {
+	Pubkey  string `json:"pubkey"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// NewPeerRejection returns the rejection of a peer for the error returned by Validate
+func NewPeerRejection(peer WireguardPeer, err error) PeerRejection {
+	rejection := PeerRejection{
+		Pubkey:  peer.Pubkey,
+		Reason:  "invalid",
+		Message: err.Error(),
+	}
+
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		rejection.Reason = validationErr.Reason
+		rejection.Message = validationErr.Message
+	}
+
+	return rejection
+}
+
+// ValidatePeers returns the valid peers in the list, and the rejections of the invalid ones
+func ValidatePeers(peers WireguardPeerList) (WireguardPeerList, []PeerRejection) {
+	valid := make(WireguardPeerList, 0, len(peers))
+	var rejections []PeerRejection
+
+	for _, peer := range peers {
+		err := peer.Validate()
+		if err != nil {
+			rejections = append(rejections, NewPeerRejection(peer, err))
+			continue
+		}
+
+		valid = append(valid, peer)
+	}
+
+	return valid, rejections
+}
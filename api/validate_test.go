@@ -0,0 +1,82 @@
+package api_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+func TestValidate(t *testing.T) {
+	valid := api.WireguardPeer{
+		IPv4:   "10.99.0.1/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+		Ports:  []int{1234, 4321},
+		Cities: []string{"se-got", ""},
+		Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*api.WireguardPeer)
+		reason string
+	}{
+		{"valid", func(p *api.WireguardPeer) {}, ""},
+		{"no cities", func(p *api.WireguardPeer) { p.Cities = nil }, ""},
+		{"no ports", func(p *api.WireguardPeer) { p.Ports = nil; p.Cities = nil }, ""},
+		{"invalid pubkey", func(p *api.WireguardPeer) { p.Pubkey = "invalid" }, api.ReasonInvalidPubkey},
+		{"short pubkey", func(p *api.WireguardPeer) { p.Pubkey = base64.StdEncoding.EncodeToString([]byte("a")) }, api.ReasonInvalidPubkey},
+		{"invalid ipv4", func(p *api.WireguardPeer) { p.IPv4 = "10.99.0.1" }, api.ReasonInvalidIPv4},
+		{"ipv4 network", func(p *api.WireguardPeer) { p.IPv4 = "10.99.0.0/24" }, api.ReasonInvalidIPv4},
+		{"ipv6 as ipv4", func(p *api.WireguardPeer) { p.IPv4 = "fc00:bbbb:bbbb:bb01::1/128" }, api.ReasonInvalidIPv4},
+		{"ipv6 network", func(p *api.WireguardPeer) { p.IPv6 = "fc00:bbbb:bbbb:bb01::/64" }, api.ReasonInvalidIPv6},
+		{"ipv4 as ipv6", func(p *api.WireguardPeer) { p.IPv6 = "10.99.0.1/32" }, api.ReasonInvalidIPv6},
+		{"port zero", func(p *api.WireguardPeer) { p.Ports[0] = 0 }, api.ReasonInvalidPort},
+		{"port too large", func(p *api.WireguardPeer) { p.Ports[1] = 65536 }, api.ReasonInvalidPort},
+		{"cities ports mismatch", func(p *api.WireguardPeer) { p.Cities = []string{"se-got"} }, api.ReasonCitiesPortsMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := valid
+			peer.Ports = append([]int{}, valid.Ports...)
+			tt.modify(&peer)
+
+			err := peer.Validate()
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			var validationErr *api.ValidationError
+			if !errors.As(err, &validationErr) || validationErr.Reason != tt.reason {
+				t.Fatalf("expected %s, got %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+func TestValidatePeers(t *testing.T) {
+	valid := api.WireguardPeer{
+		IPv4:   "10.99.0.1/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+		Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
+	}
+
+	invalid := valid
+	invalid.IPv4 = "invalid"
+
+	peers, rejections := api.ValidatePeers(api.WireguardPeerList{invalid, valid})
+	if len(peers) != 1 || peers[0].IPv4 != valid.IPv4 {
+		t.Fatalf("expected only the valid peer, got %+v", peers)
+	}
+
+	if len(rejections) != 1 || rejections[0].Pubkey != invalid.Pubkey || rejections[0].Reason != api.ReasonInvalidIPv4 {
+		t.Fatalf("unexpected rejections %+v", rejections)
+	}
+}
@@ -4,20 +4,23 @@ go 1.15
 
 require (
 	github.com/DMarby/jitter v0.0.0-20190312004500-d77fd504dcfa
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/coreos/go-iptables v0.6.0
 	github.com/digineo/go-ipset/v2 v2.2.1
-	github.com/google/go-cmp v0.5.5
+	github.com/go-redis/redis/v8 v8.11.0
+	github.com/google/go-cmp v0.5.6
+	github.com/google/nftables v0.1.0
 	github.com/infosum/statsd v2.1.2+incompatible
 	github.com/jamiealquiza/envy v1.1.0
 	github.com/klauspost/compress v1.12.2 // indirect
-	github.com/mdlayher/netlink v1.4.0
+	github.com/mdlayher/netlink v1.4.2
+	github.com/nats-io/nats-server/v2 v2.3.0
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/spf13/cobra v1.1.3 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/ti-mo/netfilter v0.4.0
-	golang.org/x/crypto v0.0.0-20210506145944-38f3c27a63bf // indirect
-	golang.org/x/net v0.0.0-20210510120150-4163338589ed // indirect
-	golang.org/x/sys v0.0.0-20210511113859-b0526f3d8744 // indirect
+	golang.org/x/sys v0.0.0-20211205182925-97ca703d548d
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20210506160403-92e472f520a5
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	nhooyr.io/websocket v1.8.7
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mullvad/wg-manager/api/subscriber"
+)
+
+// Health is the response of the health endpoint
+// The status is "degraded" while real-time events are unavailable, in which case peers are only kept up to date by synchronization
+type Health struct {
+	Status       string             `json:"status"`
+	MessageQueue MessageQueueHealth `json:"message_queue"`
+}
+
+// MessageQueueHealth is the state of the connection to the message-queue
+type MessageQueueHealth struct {
+	State         string     `json:"state"`
+	LastConnected *time.Time `json:"last_connected"`
+}
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+)
+
+// Serve the health of the daemon as JSON
+// Degraded is still reported with a 200 status code, as the peers are kept up to date regardless
+func healthHandler(s subscriber.EventSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := Health{
+			Status: healthStatusOK,
+			MessageQueue: MessageQueueHealth{
+				State: s.State().String(),
+			},
+		}
+
+		if s.State() != subscriber.StateConnected {
+			health.Status = healthStatusDegraded
+		}
+
+		if lastConnected := s.LastConnected(); !lastConnected.IsZero() {
+			health.MessageQueue.LastConnected = &lastConnected
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(health)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api/subscriber"
+	"nhooyr.io/websocket"
+)
+
+func getHealth(t *testing.T, handler http.Handler) Health {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", recorder.Code)
+	}
+
+	var health Health
+	err := json.NewDecoder(recorder.Body).Decode(&health)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return health
+}
+
+func waitForHealth(t *testing.T, handler http.Handler, status string) Health {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		health := getHealth(t, handler)
+		if health.Status == status {
+			return health
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for status %s, got %+v", status, health)
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var accept int32
+	drop := make(chan struct{}, 1)
+
+	// Reject connections until told to accept them, and keep accepted connections open until told to drop them
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&accept) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-drop:
+		case <-r.Context().Done():
+		}
+
+		c.Close(websocket.StatusGoingAway, "")
+	}))
+	defer server.Close()
+
+	metrics, err := statsd.New(statsd.Mute(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &subscriber.Subscriber{
+		BaseURL:           "ws://" + strings.TrimPrefix(server.URL, "http://"),
+		Channel:           "test",
+		Metrics:           metrics,
+		MinReconnectDelay: time.Millisecond * 10,
+		MaxReconnectDelay: time.Millisecond * 50,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.Subscribe(ctx, make(chan subscriber.WireguardEvent, 1024))
+
+	handler := healthHandler(s)
+
+	t.Run("degraded start", func(t *testing.T) {
+		health := getHealth(t, handler)
+		if health.Status != healthStatusDegraded || health.MessageQueue.LastConnected != nil {
+			t.Fatalf("unexpected health %+v", health)
+		}
+	})
+
+	var connected time.Time
+	t.Run("healthy", func(t *testing.T) {
+		atomic.StoreInt32(&accept, 1)
+
+		health := waitForHealth(t, handler, healthStatusOK)
+		if health.MessageQueue.State != subscriber.StateConnected.String() || health.MessageQueue.LastConnected == nil {
+			t.Fatalf("unexpected health %+v", health)
+		}
+
+		connected = *health.MessageQueue.LastConnected
+	})
+
+	t.Run("connection lost", func(t *testing.T) {
+		atomic.StoreInt32(&accept, 0)
+		drop <- struct{}{}
+
+		health := waitForHealth(t, handler, healthStatusDegraded)
+		if health.MessageQueue.LastConnected == nil || !health.MessageQueue.LastConnected.Equal(connected) {
+			t.Fatalf("unexpected health %+v", health)
+		}
+	})
+
+	t.Run("recovered", func(t *testing.T) {
+		atomic.StoreInt32(&accept, 1)
+
+		health := waitForHealth(t, handler, healthStatusOK)
+		if health.MessageQueue.LastConnected == nil || !health.MessageQueue.LastConnected.After(connected) {
+			t.Fatalf("unexpected health %+v", health)
+		}
+	})
+}
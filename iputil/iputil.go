@@ -32,3 +32,41 @@ func compareIPNet(ips []net.IPNet) func(i int, j int) bool {
 		return ips[i].String() < ips[j].String()
 	}
 }
+
+// Ranges of addresses that aren't reachable from the internet, in addition to loopback, link-local and multicast addresses
+var nonPublicNets = parseCIDRs(
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets
+}
+
+// IsPublic checks whether an address is a unicast address reachable from the internet
+func IsPublic(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+
+	for _, ipNet := range nonPublicNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -51,3 +51,30 @@ func TestEqualIPNet(t *testing.T) {
 		}
 	}
 }
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		IP             string
+		ExpectedResult bool
+	}{
+		{"185.65.134.1", true},
+		{"2a03:1b20:1:f011::1", true},
+		{"10.64.0.1", false},
+		{"100.64.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"127.0.0.1", false},
+		{"169.254.0.1", false},
+		{"fc00:bbbb:bbbb:bb01::1", false},
+		{"fe80::1", false},
+		{"::1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		result := iputil.IsPublic(net.ParseIP(test.IP))
+		if result != test.ExpectedResult {
+			t.Errorf("%s: got %v, expected %v", test.IP, result, test.ExpectedResult)
+		}
+	}
+}
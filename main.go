@@ -6,37 +6,53 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/DMarby/jitter"
+	"github.com/coreos/go-iptables/iptables"
 	"github.com/infosum/statsd"
 	"github.com/jamiealquiza/envy"
 	"github.com/mullvad/wg-manager/api"
 	"github.com/mullvad/wg-manager/api/subscriber"
 	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/state"
+	"github.com/mullvad/wg-manager/tlsconfig"
 	"github.com/mullvad/wg-manager/wireguard"
 )
 
 var (
 	a          *api.API
 	wg         *wireguard.Wireguard
-	pf         *portforward.Portforward
+	pf         portforward.Backend
+	bootstrap  *portforward.Portforward   // Set when the portforwarding chains and ipsets are created and repaired by wg-manager
+	exits      *portforward.ExitAddresses // Set when the exit addresses matched by the portforwarding rules are managed by wg-manager
 	metrics    *statsd.Client
 	appVersion string // Populated during build time
+	cursor     string // Cursor for delta synchronization, empty until a full synchronization has been made
+	cursorPath string // Where to persist the cursor, empty if it should only be kept in memory
+
+	peerCachePath string // Where to persist the last list of peers fetched, empty if it shouldn't be persisted
 )
 
 func main() {
 	// Set up commandline flags
 	countPeerInterval := flag.Duration("count-peer-interval", time.Minute, "how often wireguard peers will be counted and reported to statsd and the api")
 	synchronizationInterval := flag.Duration("synchronization-interval", time.Minute, "how often wireguard peers will be synchronized with the api")
+	fullSynchronizationInterval := flag.Duration("full-synchronization-interval", time.Minute*15, "how often wireguard peers will be synchronized with the api even if the api reports them as unchanged")
+	deltaSynchronizationInterval := flag.Duration("delta-synchronization-interval", 0, "how often changes to the wireguard peers will be fetched from the api, in between full synchronizations. 0 disables delta synchronization")
 	resetHandshakeInterval := flag.Duration("reset-handshake-interval", time.Minute, "how often wireguard peers will have their handshakes checked for resets")
 	delay := flag.Duration("delay", time.Second*45, "max random delay for the synchronization")
 	apiTimeout := flag.Duration("api-timeout", time.Second*30, "max duration for API requests")
+	apiRetries := flag.Int("api-retries", 3, "how many times API requests will be retried on server and connection errors")
+	apiRetryDelay := flag.Duration("api-retry-delay", time.Second, "delay before the first retry of an API request, doubled for every retry")
+	apiMaxRetryDelay := flag.Duration("api-max-retry-delay", time.Second*10, "max delay between retries of an API request")
 	url := flag.String("url", "https://example.com", "api url")
 	username := flag.String("username", "", "api username")
 	password := flag.String("password", "", "api password")
@@ -46,11 +62,37 @@ func main() {
 	portForwardingChainPrefix := flag.String("portforwarding-chain-prefix", "PORTFORWARDING", "iptables chain prefix to use for portforwarding")
 	portForwardingIpsetIPv4 := flag.String("portforwarding-ipset-ipv4", "PORTFORWARDING_IPV4", "ipset table to use for portforwarding for ipv4 addresses.")
 	portForwardingIpsetIPv6 := flag.String("portforwarding-ipset-ipv6", "PORTFORWARDING_IPV6", "ipset table to use for portforwarding for ipv6 addresses.")
+	portForwardingBackend := flag.String("portforwarding-backend", "iptables", "how to apply portforwarding rules, either iptables or nftables")
+	portForwardingNFTablesTable := flag.String("portforwarding-nftables-table", "wg-manager", "nftables table to use for portforwarding, when using the nftables backend")
+	portForwardingExitAddresses := flag.String("portforwarding-exit-addresses", "", "comma-separated list of exit addresses to keep in the portforwarding ipsets")
+	portForwardingExitInterfaces := flag.String("portforwarding-exit-interfaces", "", "comma-separated list of network interfaces whose public addresses are kept in the portforwarding ipsets")
+	portForwardingExitAddressInterval := flag.Duration("portforwarding-exit-address-interval", time.Second*10, "how often the exit addresses in the portforwarding ipsets, and of the portforwarding-exit-interfaces, are checked for changes")
+	portForwardingForwardFilter := flag.Bool("portforwarding-forward-filter", false, "manage an iptables filter chain which only accepts the forwarded ports to each peer, and drops other DNATed traffic")
+	portForwardingBootstrap := flag.Bool("portforwarding-bootstrap", false, "create the iptables portforwarding chains, the jump rules to them and the ipsets if they don't exist, and repair them on every synchronization")
 	statsdAddress := flag.String("statsd-address", "127.0.0.1:8125", "statsd address to send metrics to")
-	mqURL := flag.String("mq-url", "wss://example.com/mq", "message-queue url")
+	healthAddress := flag.String("health-address", "", "address to serve the health status on, at /health. Disabled if empty")
+	mqURL := flag.String("mq-url", "wss://example.com/mq", "message-queue url. The scheme selects the protocol, either ws/wss, http/https for server-sent events, nats/tls for NATS or redis/rediss for Redis Pub/Sub")
 	mqUsername := flag.String("mq-username", "", "message-queue username")
 	mqPassword := flag.String("mq-password", "", "message-queue password")
-	mqChannel := flag.String("mq-channel", "wireguard", "message-queue channel")
+	mqChannel := flag.String("mq-channel", "wireguard", "message-queue channel, or subject for NATS")
+	mqDurable := flag.String("mq-durable", "", "name of the JetStream durable consumer to use for NATS, so that events are replayed after reconnecting. Core NATS is used if empty")
+	eventBatchWindow := flag.Duration("event-batch-window", time.Millisecond*100, "how long to wait for more message-queue events after receiving one, to apply them together")
+	eventBatchSize := flag.Int("event-batch-size", 500, "max number of message-queue events to apply together")
+	eventQueueSize := flag.Int("event-queue-size", 1024, "max number of message-queue events waiting to be applied")
+	eventQueueHighWaterMark := flag.Int("event-queue-high-water-mark", 768, "number of queued message-queue events after which they're dropped in favor of a full synchronization")
+	mqSigningKeys := flag.String("mq-signing-keys", "", "base64 encoded Ed25519 public keys that message-queue events must be signed with, unsigned events, including RESYNC events, are dropped. Pass a comma delimited list to trust multiple keys while rotating. Signatures aren't verified if empty")
+	mqSignatureMaxAge := flag.Duration("mq-signature-max-age", time.Minute*5, "max difference between the timestamp of a signed message-queue event and the current time")
+	mqMinReconnectDelay := flag.Duration("mq-min-reconnect-delay", time.Second, "delay before the first attempt to reconnect to the message-queue, doubled for every failed attempt")
+	mqMaxReconnectDelay := flag.Duration("mq-max-reconnect-delay", time.Minute, "max delay between attempts to reconnect to the message-queue, the delay only starts over once a connection has stayed up this long")
+	mqIdleTimeout := flag.Duration("mq-idle-timeout", time.Minute*2, "how long a server-sent events message-queue connection can go without receiving anything, including keep-alives, before it's reestablished")
+	tlsCert := flag.String("tls-cert", "", "client certificate in PEM format to present to the api and message-queue, reloaded when it changes")
+	tlsKey := flag.String("tls-key", "", "private key in PEM format for the client certificate, reloaded when it changes")
+	tlsCA := flag.String("tls-ca", "", "CA bundle in PEM format to verify the api and message-queue with instead of the system roots, reloaded when it changes")
+	tlsPinnedPublicKeys := flag.String("tls-pinned-public-keys", "", "base64 encoded SHA-256 hashes of the public keys the api and message-queue certificates must have. Pass a comma delimited list to allow multiple keys")
+	stateDirectory := flag.String("state-directory", "", "directory to persist state in across restarts, such as the delta synchronization cursor. State is only kept in memory if empty")
+	peerCacheMaxAge := flag.Duration("peer-cache-max-age", time.Hour*24, "max age of the persisted list of wireguard peers to use on startup if the api is unreachable")
+	planFormat := flag.String("plan-format", "text", "output format of the plan command, either 'text' or 'json'")
+	simulate := flag.Bool("simulate", false, "use in-memory wireguard interfaces, iptables and metrics instead of the system ones, and log every change to stdout")
 
 	// Parse environment variables
 	envy.Parse("WG")
@@ -66,16 +108,49 @@ func main() {
 		os.Exit(0)
 	}
 
+	command := flag.Arg(0)
+	if command != "" && command != "plan" {
+		log.Fatalf("unknown command %s", command)
+	}
+
+	// Flags after the command aren't parsed, so they would be silently ignored
+	if flag.NArg() > 1 {
+		log.Fatalf("unexpected arguments %s after the %s command, flags must be passed before it", strings.Join(flag.Args()[1:], " "), command)
+	}
+
 	log.Printf("starting wg-manager %s", appVersion)
 
+	if *simulate {
+		log.Printf("running in simulation mode, no changes will be made to the system")
+	}
+
 	// Initialize metrics
 	var err error
-	metrics, err = statsd.New(statsd.TagsFormat(statsd.Datadog), statsd.Prefix("wireguard"), statsd.Address(*statsdAddress))
+	metrics, err = statsd.New(statsd.TagsFormat(statsd.Datadog), statsd.Prefix("wireguard"), statsd.Address(*statsdAddress), statsd.Mute(*simulate))
 	if err != nil {
 		log.Fatalf("Error initializing metrics %s", err)
 	}
 	defer metrics.Close()
 
+	// Initialize TLS, shared between the API and the message-queue
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" || *tlsPinnedPublicKeys != "" {
+		var pinnedPublicKeys []string
+		if *tlsPinnedPublicKeys != "" {
+			pinnedPublicKeys = strings.Split(*tlsPinnedPublicKeys, ",")
+		}
+
+		transport.TLSClientConfig, err = tlsconfig.New(tlsconfig.Config{
+			CertFile:         *tlsCert,
+			KeyFile:          *tlsKey,
+			CAFile:           *tlsCA,
+			PinnedPublicKeys: pinnedPublicKeys,
+		})
+		if err != nil {
+			log.Fatalf("error initializing tls %s", err)
+		}
+	}
+
 	// Initialize the API
 	a = &api.API{
 		Username: *username,
@@ -83,8 +158,12 @@ func main() {
 		BaseURL:  *url,
 		Hostname: *hostname,
 		Client: &http.Client{
-			Timeout: *apiTimeout,
+			Timeout:   *apiTimeout,
+			Transport: transport,
 		},
+		Retries:       *apiRetries,
+		RetryDelay:    *apiRetryDelay,
+		MaxRetryDelay: *apiMaxRetryDelay,
 	}
 
 	// Initialize Wireguard
@@ -94,70 +173,250 @@ func main() {
 
 	interfacesList := strings.Split(*interfaces, ",")
 
-	wg, err = wireguard.New(interfacesList)
+	if *simulate {
+		// Calls aren't recorded, so that memory use doesn't grow with every change while simulating
+		device := wireguard.NewMemoryDevice(interfacesList...)
+		device.Log = os.Stdout
+		wg, err = wireguard.NewWithDevice(device, interfacesList)
+	} else {
+		wg, err = wireguard.New(interfacesList)
+	}
 	if err != nil {
 		log.Fatalf("error initializing wireguard %s", err)
 	}
 	defer wg.Close()
 
-	// Initialize portforward
-	pf, err = portforward.New(
-		*portForwardingChainPrefix,
-		*portForwardingIpsetIPv4,
-		*portForwardingIpsetIPv6,
-		*location)
+	// Initialize portforward, along with the sets of exit addresses the rules match
+	var exitSets portforward.AddressSets
+	var iptablesPortforward *portforward.Portforward
+	if *simulate {
+		ipt := newSimulatedIPTables(iptables.ProtocolIPv4, *portForwardingChainPrefix)
+		ip6t := newSimulatedIPTables(iptables.ProtocolIPv6, *portForwardingChainPrefix)
+		iptablesPortforward, err = portforward.NewWithIPTables(
+			ipt,
+			ip6t,
+			*portForwardingChainPrefix,
+			*portForwardingIpsetIPv4,
+			*portForwardingIpsetIPv6,
+			*location)
+		exitSets = newSimulatedIPSets(*portForwardingIpsetIPv4, *portForwardingIpsetIPv6)
+	} else if *portForwardingBackend == "nftables" && *portForwardingForwardFilter {
+		err = fmt.Errorf("the forward filter chain isn't supported by the nftables backend")
+	} else if *portForwardingBackend == "nftables" {
+		// Planning doesn't create the table or replace its rules
+		newNFTables := portforward.NewNFTables
+		if command == "plan" {
+			newNFTables = portforward.NewNFTablesForPlan
+		}
+
+		var n *portforward.NFTables
+		n, err = newNFTables(
+			*portForwardingNFTablesTable,
+			*portForwardingIpsetIPv4,
+			*portForwardingIpsetIPv6,
+			*location)
+		pf, exitSets = n, n
+	} else if *portForwardingBackend == "iptables" && *portForwardingBootstrap {
+		// Planning reports what would be created or repaired instead
+		newBootstrapped := portforward.NewBootstrapped
+		if command == "plan" {
+			newBootstrapped = portforward.NewBootstrappedForPlan
+		}
+
+		bootstrap, err = newBootstrapped(
+			*portForwardingChainPrefix,
+			*portForwardingIpsetIPv4,
+			*portForwardingIpsetIPv6,
+			*location)
+		iptablesPortforward, exitSets = bootstrap, portforward.NewSystemIPSets()
+	} else if *portForwardingBackend == "iptables" {
+		iptablesPortforward, err = portforward.New(
+			*portForwardingChainPrefix,
+			*portForwardingIpsetIPv4,
+			*portForwardingIpsetIPv6,
+			*location)
+		exitSets = portforward.NewSystemIPSets()
+	} else {
+		err = fmt.Errorf("unknown backend %s", *portForwardingBackend)
+	}
+
+	if err == nil && iptablesPortforward != nil {
+		pf = iptablesPortforward
+		if *portForwardingForwardFilter {
+			err = iptablesPortforward.EnableForwardFilter()
+		}
+	}
 
 	if err != nil {
 		log.Fatalf("error initializing portforwarding %s", err)
 	}
 
+	// Manage the exit addresses, if configured
+	var exitAddressC <-chan time.Time
+	if *portForwardingExitAddresses != "" || *portForwardingExitInterfaces != "" {
+		var addresses []net.IP
+		if *portForwardingExitAddresses != "" {
+			addresses, err = portforward.ParseAddresses(strings.Split(*portForwardingExitAddresses, ","))
+			if err != nil {
+				log.Fatalf("error initializing exit addresses %s", err)
+			}
+		}
+
+		var exitInterfaces []string
+		if *portForwardingExitInterfaces != "" {
+			exitInterfaces = strings.Split(*portForwardingExitInterfaces, ",")
+		}
+
+		// Check the sets even if only addresses are configured, in case another tool changed them
+		exitAddressTicker := time.NewTicker(*portForwardingExitAddressInterval)
+		defer exitAddressTicker.Stop()
+		exitAddressC = exitAddressTicker.C
+
+		exits = portforward.NewExitAddresses(exitSets, *portForwardingIpsetIPv4, *portForwardingIpsetIPv6, addresses, exitInterfaces)
+	}
+
+	// Print the changes a synchronization would make and exit
+	if command == "plan" {
+		err = plan(os.Stdout, *planFormat)
+		if err != nil {
+			log.Fatalf("error creating plan %s", err)
+		}
+
+		return
+	}
+
 	// Set up context for shutting down
 	shutdownCtx, shutdown := context.WithCancel(context.Background())
 	defer shutdown()
 
-	// Run an initial synchronization
-	synchronize()
+	// Resume delta synchronization from where we left off, if the previous cursor is still valid
+	if *deltaSynchronizationInterval > 0 && *stateDirectory != "" && !*simulate {
+		cursorPath = filepath.Join(*stateDirectory, "cursor")
+		cursor, err = state.LoadCursor(cursorPath)
+		if err != nil {
+			log.Printf("error loading delta synchronization cursor %s", err.Error())
+		}
+	}
+
+	if *stateDirectory != "" && !*simulate {
+		peerCachePath = filepath.Join(*stateDirectory, "peers.json")
+	}
+
+	if exits != nil {
+		updateExitAddresses()
+	}
+
+	// Run an initial synchronization, which is a full synchronization unless we have a cursor
+	initialSynchronize(*peerCacheMaxAge)
 
 	// Run an initial count of peers
 	countPeers()
 
 	// Set up a connection to receive add/remove events
-	s := subscriber.Subscriber{
+	events, err := subscriber.New(subscriber.Config{
+		URL:      *mqURL,
 		Username: *mqUsername,
 		Password: *mqPassword,
-		BaseURL:  *mqURL,
 		Channel:  *mqChannel,
 		Metrics:  metrics,
+		HTTPClient: &http.Client{
+			Transport: transport,
+		},
+		TLSConfig:         transport.TLSClientConfig,
+		API:               a,
+		Durable:           *mqDurable,
+		MinReconnectDelay: *mqMinReconnectDelay,
+		MaxReconnectDelay: *mqMaxReconnectDelay,
+		IdleTimeout:       *mqIdleTimeout,
+	})
+	if err != nil {
+		log.Fatalf("error initializing message-queue %s", err)
 	}
-	eventChannel := make(chan subscriber.WireguardEvent, 1024)
-	defer close(eventChannel)
 
-	err = s.Subscribe(shutdownCtx, eventChannel)
-	if err != nil {
-		log.Fatal("error connecting to message-queue", err)
+	// Only accept events signed by a trusted key, if configured
+	var verifier *subscriber.Verifier
+	if *mqSigningKeys != "" {
+		verifier, err = subscriber.NewVerifier(strings.Split(*mqSigningKeys, ","), *mqSignatureMaxAge, metrics)
+		if err != nil {
+			log.Fatalf("error initializing message-queue signature verification %s", err)
+		}
+	}
+
+	// The event source is never blocked by a slow main loop, if too many events are queued they're dropped and a full synchronization is run instead
+	queue := subscriber.NewQueue(*eventQueueSize, *eventQueueHighWaterMark, metrics)
+	eventChannel := make(chan subscriber.WireguardEvent)
+	go queue.Forward(shutdownCtx, eventChannel)
+
+	// If the message-queue is unreachable we keep trying in the background, and rely on synchronization in the meantime
+	events.Subscribe(shutdownCtx, eventChannel)
+
+	// Serve the health status, so that a degraded message-queue connection can be monitored
+	if *healthAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/health", healthHandler(events))
+
+		healthServer := &http.Server{
+			Addr:    *healthAddress,
+			Handler: mux,
+		}
+		defer healthServer.Close()
+
+		go func() {
+			err := healthServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("error serving health status %s", err.Error())
+			}
+		}()
 	}
 
 	// Create a ticker to run our logic for polling the api and updating wireguard peers
 	countPeersTicker := jitter.NewTicker(*countPeerInterval, time.Microsecond)
 	synchronizationTicker := jitter.NewTicker(*synchronizationInterval, *delay)
+	fullSynchronizationTicker := time.NewTicker(*fullSynchronizationInterval)
 	resetHandshakeTicker := jitter.NewTicker(*resetHandshakeInterval, time.Microsecond)
+
+	// Delta synchronization is optional, a nil channel is never selected
+	var deltaSynchronizationC <-chan time.Time
+	if *deltaSynchronizationInterval > 0 {
+		deltaSynchronizationTicker := time.NewTicker(*deltaSynchronizationInterval)
+		defer deltaSynchronizationTicker.Stop()
+		deltaSynchronizationC = deltaSynchronizationTicker.C
+	}
+
 	go func() {
 		for {
 			select {
-			case msg := <-eventChannel:
-				handleEvent(msg)
+			case msg := <-queue.C:
+				// Apply the events that arrive close together at once, to make fewer changes to the interfaces and rules
+				events := collectEvents(msg, queue.C, *eventBatchWindow, *eventBatchSize)
+				handleEvents(coalesceEvents(validateEvents(verifyEvents(verifier, events))))
+			case <-queue.NeedsSync:
+				// Queued events were dropped, so the peers may have changed even if the API reports the list as unchanged
+				metrics.Increment("forced_synchronizations")
+				log.Printf("event queue overflowed, running a full synchronization")
+				a.ResetConditionalRequests()
+				synchronize()
 			case <-countPeersTicker.C:
 				countPeers()
 			case <-synchronizationTicker.C:
 				// We run this synchronously, the ticker will drop ticks if this takes too long
 				// This way we don't need a mutex or similar to ensure it doesn't run concurrently either
 				synchronize()
-				metrics.Gauge("eventchannel_length", len(eventChannel))
+				metrics.Gauge("eventchannel_length", queue.Len())
+				metrics.Gauge("mq_state", int(events.State()))
+			case <-deltaSynchronizationC:
+				deltaSynchronize()
+			case <-exitAddressC:
+				updateExitAddresses()
+			case <-fullSynchronizationTicker.C:
+				// Make sure the next synchronization isn't skipped, in case something else has changed the interfaces or rules
+				a.ResetConditionalRequests()
 			case <-resetHandshakeTicker.C:
 				resetHandshake()
 			case <-shutdownCtx.Done():
 				countPeersTicker.Stop()
 				synchronizationTicker.Stop()
+				fullSynchronizationTicker.Stop()
 				resetHandshakeTicker.Stop()
 				return
 			}
@@ -169,28 +428,122 @@ func main() {
 	log.Printf("shutting down: %s", err)
 }
 
-func handleEvent(event subscriber.WireguardEvent) {
+// Collect the events arriving within the batch window after the first one, up to the max batch size
+func collectEvents(first subscriber.WireguardEvent, eventChannel <-chan subscriber.WireguardEvent, window time.Duration, maxSize int) []subscriber.WireguardEvent {
+	events := []subscriber.WireguardEvent{first}
 
-	switch event.Action {
-	case "ADD":
-		t := metrics.NewTiming()
-		wg.AddPeer(event.Peer)
-		t.Send("add_event_add_peer_time")
-		t = metrics.NewTiming()
-		pf.AddPortforwarding(event.Peer)
-		t.Send("add_event_add_portforwarding_time")
-	case "REMOVE":
-		t := metrics.NewTiming()
-		wg.RemovePeer(event.Peer)
-		t.Send("remove_event_remove_peer_time")
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+
+	for len(events) < maxSize {
+		select {
+		case event := <-eventChannel:
+			events = append(events, event)
+		case <-timer.C:
+			return events
+		}
+	}
+
+	return events
+}
+
+// Drop the events that aren't signed by a trusted key, if signatures are verified
+func verifyEvents(verifier *subscriber.Verifier, events []subscriber.WireguardEvent) []subscriber.WireguardEvent {
+	if verifier == nil {
+		return events
+	}
+
+	verified := events[:0]
+	for _, event := range events {
+		err := verifier.Verify(event)
+		if err != nil {
+			metrics.Increment("dropped_unverified_events")
+			log.Printf("dropping event %s for %s: %s", event.Action, event.Peer.Pubkey, err.Error())
+			continue
+		}
+
+		verified = append(verified, event)
+	}
+
+	return verified
+}
+
+// Drop the events that can't be applied, such as those with an invalid peer
+func validateEvents(events []subscriber.WireguardEvent) []subscriber.WireguardEvent {
+	valid := events[:0]
+	for _, event := range events {
+		err := event.Validate()
+		if err != nil {
+			var validationErr *api.ValidationError
+			if errors.As(err, &validationErr) {
+				metrics.Increment("invalid_event_" + validationErr.Reason)
+			}
+
+			log.Printf("dropping invalid event %s for %s: %s", event.Action, event.Peer.Pubkey, err.Error())
+			continue
+		}
+
+		valid = append(valid, event)
+	}
+
+	return valid
+}
+
+// Reduce the events to one per peer, so that short-lived changes aren't applied
+func coalesceEvents(events []subscriber.WireguardEvent) []subscriber.WireguardEvent {
+	coalesced := subscriber.Coalesce(events)
+	metrics.Count("coalesced_events", len(events)-len(coalesced))
+
+	return coalesced
+}
+
+// Apply a batch of events in order, with one wireguard configuration change per interface and one iptables transaction per protocol
+func handleEvents(events []subscriber.WireguardEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	defer metrics.NewTiming().Send("handle_events_time")
+	metrics.Histogram("event_batch_size", len(events))
+
+	// Events for the same key are coalesced, so there's at most one per peer
+	var addedPeers, removedPeers []api.WireguardPeer
+	batch := portforward.NewBatch()
+	resync := false
+
+	for _, event := range events {
+		switch event.Action {
+		case subscriber.ActionAdd:
+			addedPeers = append(addedPeers, event.Peer)
+			batch.Add(event.Peer)
+		case subscriber.ActionRemove:
+			removedPeers = append(removedPeers, event.Peer)
+			batch.Remove(event.Peer)
+		case subscriber.ActionUpdatePorts:
+			batch.Update(event.Peer)
+		case subscriber.ActionResync:
+			resync = true
+		}
+	}
+
+	t := metrics.NewTiming()
+	wg.ApplyPeers(addedPeers, removedPeers)
+	t.Send("event_batch_apply_peers_time")
+
+	if batch.Len() > 0 {
 		t = metrics.NewTiming()
-		pf.RemovePortforwarding(event.Peer)
-		t.Send("remove_event_remove_portforwarding_time")
-	case "UPDATE_PORTS":
-		t := metrics.NewTiming()
-		pf.UpdateSinglePeerPortforwarding(event.Peer)
-		t.Send("update_ports_event_update_portforwarding_time")
-	default: // Bad data from the API, ignore it
+		err := pf.ApplyBatch(batch)
+		if err != nil {
+			metrics.Increment("error_applying_portforwarding_batch")
+			log.Printf("error applying portforwarding for events %s", err.Error())
+		}
+		t.Send("event_batch_apply_portforwarding_time")
+	}
+
+	if resync {
+		// Events have been missed, so the peers may have changed even if the API reports the list as unchanged
+		a.ResetConditionalRequests()
+		synchronize()
 	}
 }
 
@@ -211,25 +564,302 @@ func countPeers() {
 	t.Send("post_wireguard_connections_time")
 }
 
-func synchronize() {
+// errApplyingPeers is returned by synchronize when the peers were fetched from the API, but couldn't all be applied
+var errApplyingPeers = errors.New("error applying peers")
+
+// Run a full synchronization, or a delta synchronization if we have a cursor
+// If the peers can't be fetched from the API, the peers persisted by the last successful synchronization are applied instead
+func initialSynchronize(peerCacheMaxAge time.Duration) {
+	if cursor != "" {
+		deltaSynchronize()
+		return
+	}
+
+	// Peers that were fetched but couldn't all be applied are still newer than the cached ones
+	err := synchronize()
+	if err != nil && !errors.Is(err, errApplyingPeers) && peerCachePath != "" {
+		// Serve the peers we knew about last, rather than no peers at all until the API is reachable again
+		restorePeerCache(peerCacheMaxAge)
+	}
+}
+
+func synchronize() error {
 	defer metrics.NewTiming().Send("synchronize_time")
 
+	if bootstrap != nil {
+		bootstrapPortforwarding()
+	}
+
+	// Decode the peers straight into the sets used for comparison, rather than keeping the whole list in memory
+	peerSet := wireguard.NewPeerSet()
+	ruleSet := pf.NewRuleSet()
+
+	// Write the peers to disk as well, so that they can be restored if the API is unreachable on startup
+	var cache *state.PeerCacheWriter
+	if peerCachePath != "" {
+		var err error
+		cache, err = state.CreatePeerCache(peerCachePath)
+		if err != nil {
+			metrics.Increment("error_writing_peer_cache")
+			log.Printf("error writing peer cache %s", err.Error())
+		}
+	}
+
+	// Invalid peers are left out, and reported once the whole list has been validated
+	var rejections []api.PeerRejection
+
 	t := metrics.NewTiming()
-	peers, err := a.GetWireguardPeers()
+	err := a.StreamWireguardPeers(func(peer api.WireguardPeer) error {
+		if err := peer.Validate(); err != nil {
+			rejections = append(rejections, api.NewPeerRejection(peer, err))
+			return nil
+		}
+
+		peerSet.Add(peer)
+		ruleSet.Add(peer)
+
+		// Errors are reported when committing, they shouldn't stop the synchronization
+		if cache != nil {
+			cache.Add(peer)
+		}
+
+		return nil
+	})
+	if err != nil && cache != nil {
+		cache.Abort()
+	}
+	if errors.Is(err, api.ErrNotModified) {
+		// Nothing has changed since the last synchronization
+		t.Send("get_wireguard_peers_time")
+		metrics.Increment("get_wireguard_peers_not_modified")
+		return nil
+	}
 	if err != nil {
 		metrics.Increment("error_getting_peers")
 		log.Printf("error getting peers %s", err.Error())
-		return
+		return err
 	}
 	t.Send("get_wireguard_peers_time")
+	metrics.Increment("get_wireguard_peers_modified")
+
+	if cache != nil {
+		err = cache.Commit()
+		if err != nil {
+			metrics.Increment("error_writing_peer_cache")
+			log.Printf("error writing peer cache %s", err.Error())
+		}
+	}
 
 	t = metrics.NewTiming()
-	wg.UpdatePeers(peers)
+	peersErr := wg.UpdatePeerSet(peerSet)
 	t.Send("update_peers_time")
 
 	t = metrics.NewTiming()
-	pf.UpdatePortforwarding(peers)
+	rulesErr := pf.UpdateRuleSet(ruleSet)
 	t.Send("update_portforwarding_time")
+
+	// The API would report the list as unchanged until the next full synchronization, so make sure the next synchronization applies it again
+	err = peersErr
+	if err == nil {
+		err = rulesErr
+	}
+	if err != nil {
+		metrics.Increment("error_applying_peers")
+		a.ResetConditionalRequests()
+		err = fmt.Errorf("%w %s", errApplyingPeers, err.Error())
+	} else if c := a.Cursor(); c != "" {
+		setCursor(c)
+	}
+
+	// Reported once the valid peers are applied, so that a slow report doesn't hold them up
+	reportRejections(rejections, true)
+
+	return err
+}
+
+// Create anything needed for portforwarding that another tool removed, and notice chains that another tool flushed
+// The rules that were removed along with it are put back by fetching the whole list of peers, even if it hasn't changed
+func bootstrapPortforwarding() {
+	repaired, err := bootstrap.Bootstrap()
+	if err != nil {
+		metrics.Increment("error_bootstrapping_portforwarding")
+		log.Printf("error bootstrapping portforwarding %s", err.Error())
+	}
+
+	if repaired {
+		metrics.Increment("repaired_portforwarding")
+		a.ResetConditionalRequests()
+
+		// Recreated ipsets are empty
+		if exits != nil {
+			updateExitAddresses()
+		}
+	}
+}
+
+// Add the exit addresses missing from the portforwarding sets, and remove the ones that aren't exit addresses anymore
+func updateExitAddresses() {
+	defer metrics.NewTiming().Send("update_exit_addresses_time")
+
+	err := exits.Update()
+	if err != nil {
+		metrics.Increment("error_updating_exit_addresses")
+		log.Printf("error updating exit addresses %s", err.Error())
+	}
+}
+
+// The peer rejections reported to the API, so that the same ones aren't reported on every synchronization
+var reportedRejections = make(map[api.PeerRejection]bool)
+
+// Report the peers rejected by validation to the API and as metrics, so that bad data gets noticed
+// Every rejection is counted in the metrics, but only the ones that are new or have changed are logged and reported to the API
+// If complete is set, the rejections are all the current ones, and the ones that are gone are reported again if they come back
+func reportRejections(rejections []api.PeerRejection, complete bool) {
+	if len(rejections) > 0 {
+		metrics.Count("rejected_peers", len(rejections))
+	}
+
+	current := make(map[api.PeerRejection]bool)
+	var unreported []api.PeerRejection
+	for _, rejection := range rejections {
+		metrics.Increment("rejected_peer_" + rejection.Reason)
+
+		if !reportedRejections[rejection] && !current[rejection] {
+			log.Printf("rejected peer %s: %s", rejection.Pubkey, rejection.Message)
+			unreported = append(unreported, rejection)
+		}
+
+		current[rejection] = true
+	}
+
+	if complete {
+		for rejection := range reportedRejections {
+			if !current[rejection] {
+				delete(reportedRejections, rejection)
+			}
+		}
+	}
+
+	if len(unreported) == 0 {
+		return
+	}
+
+	t := metrics.NewTiming()
+	err := a.PostWireguardPeerRejections(unreported)
+	if err != nil {
+		// Reported again by the next synchronization
+		metrics.Increment("error_posting_peer_rejections")
+		log.Printf("error posting peer rejections %s", err.Error())
+		return
+	}
+	t.Send("post_wireguard_peer_rejections_time")
+
+	for _, rejection := range unreported {
+		reportedRejections[rejection] = true
+	}
+}
+
+// Apply the peers persisted by the last successful synchronization
+func restorePeerCache(maxAge time.Duration) {
+	peerSet := wireguard.NewPeerSet()
+	ruleSet := pf.NewRuleSet()
+
+	err := state.ReadPeerCache(peerCachePath, maxAge, func(peer api.WireguardPeer) error {
+		// The cache only contains peers that were valid when it was written, but it may have been written by an older version
+		if peer.Validate() != nil {
+			return nil
+		}
+
+		peerSet.Add(peer)
+		ruleSet.Add(peer)
+		return nil
+	})
+	if err != nil {
+		metrics.Increment("error_restoring_peer_cache")
+		log.Printf("error restoring peer cache %s", err.Error())
+		return
+	}
+
+	t := metrics.NewTiming()
+	wg.UpdatePeerSet(peerSet)
+	t.Send("update_peers_time")
+
+	t = metrics.NewTiming()
+	pf.UpdateRuleSet(ruleSet)
+	t.Send("update_portforwarding_time")
+
+	metrics.Increment("restored_peer_cache")
+	log.Printf("restored %d peers from the peer cache", peerSet.Len())
+}
+
+// Apply the changes since the last synchronization, falling back to a full synchronization if there is no valid cursor
+func deltaSynchronize() {
+	if cursor == "" {
+		synchronize()
+		return
+	}
+
+	defer metrics.NewTiming().Send("delta_synchronize_time")
+
+	t := metrics.NewTiming()
+	delta, err := a.GetWireguardPeerDelta(cursor)
+	if errors.Is(err, api.ErrCursorExpired) {
+		metrics.Increment("delta_cursor_expired")
+		log.Printf("delta synchronization cursor expired, running a full synchronization")
+
+		// Make sure the full synchronization isn't skipped, as the changes since the cursor are unknown
+		cursor = ""
+		a.ResetConditionalRequests()
+		synchronize()
+		return
+	}
+	if err != nil {
+		metrics.Increment("error_getting_peer_delta")
+		log.Printf("error getting peer delta %s", err.Error())
+		return
+	}
+	t.Send("get_wireguard_peer_delta_time")
+
+	added, addedRejections := api.ValidatePeers(delta.Added)
+	updated, updatedRejections := api.ValidatePeers(delta.Updated)
+
+	// Removed peers are removed from the interfaces by key, even if the rest of their data is missing or invalid
+	// Portforwarding rules can't be found from a key alone, so the rules of a removed peer without valid addresses and ports are left until the next full synchronization
+	for _, peer := range delta.Removed {
+		wg.RemovePeerKey(peer.Pubkey)
+		pf.RemovePortforwarding(peer)
+	}
+
+	for _, peer := range added {
+		wg.AddPeer(peer)
+		pf.AddPortforwarding(peer)
+	}
+
+	for _, peer := range updated {
+		wg.AddPeer(peer)
+		pf.UpdateSinglePeerPortforwarding(peer)
+	}
+
+	metrics.Count("delta_peers_removed", len(delta.Removed))
+	metrics.Count("delta_peers_added", len(delta.Added))
+	metrics.Count("delta_peers_updated", len(delta.Updated))
+
+	setCursor(delta.Cursor)
+
+	reportRejections(append(addedRejections, updatedRejections...), false)
+}
+
+func setCursor(c string) {
+	cursor = c
+	if cursorPath == "" {
+		return
+	}
+
+	err := state.SaveCursor(cursorPath, c)
+	if err != nil {
+		metrics.Increment("error_saving_cursor")
+		log.Printf("error saving delta synchronization cursor %s", err.Error())
+	}
 }
 
 func resetHandshake() {
@@ -237,6 +867,38 @@ func resetHandshake() {
 	wg.ResetPeers()
 }
 
+// Create in-memory iptables with the portforwarding chains, which logs every change to stdout
+func newSimulatedIPTables(protocol iptables.Protocol, chainPrefix string) *portforward.MemoryIPTables {
+	ipt := portforward.NewMemoryIPTables(protocol)
+	ipt.Log = os.Stdout
+
+	for _, chain := range portforward.ChainNames(chainPrefix) {
+		err := ipt.NewChain("nat", chain)
+		if err != nil {
+			log.Fatalf("error creating simulated iptables chain %s", err)
+		}
+	}
+
+	err := ipt.NewChain("filter", portforward.ForwardChainName(chainPrefix))
+	if err != nil {
+		log.Fatalf("error creating simulated iptables chain %s", err)
+	}
+
+	return ipt
+}
+
+func newSimulatedIPSets(ipsetIPv4 string, ipsetIPv6 string) *portforward.MemoryIPSets {
+	ipsets := portforward.NewMemoryIPSets()
+	for name, protocol := range map[string]iptables.Protocol{ipsetIPv4: iptables.ProtocolIPv4, ipsetIPv6: iptables.ProtocolIPv6} {
+		err := ipsets.CreateSet(name, protocol)
+		if err != nil {
+			log.Fatalf("error creating simulated ipset %s", err)
+		}
+	}
+
+	return ipsets
+}
+
 func waitForInterrupt(ctx context.Context) error {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/wireguard"
+)
+
+// Plan contains the changes a synchronization would make
+type Plan struct {
+	Peers []wireguard.PeerChange   `json:"peers"`
+	Rules []portforward.RuleChange `json:"rules"`
+}
+
+// Fetch the peers from the API, and write the changes a synchronization would make to w, without applying them
+func plan(w io.Writer, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown plan format %s", format)
+	}
+
+	peers, err := a.GetWireguardPeers()
+	if err != nil {
+		return fmt.Errorf("error getting peers %s", err.Error())
+	}
+
+	// Invalid peers would be left out by a synchronization as well
+	peers, _ = api.ValidatePeers(peers)
+
+	p := Plan{
+		Peers: []wireguard.PeerChange{},
+		Rules: []portforward.RuleChange{},
+	}
+
+	peerChanges, err := wg.PlanPeers(peers)
+	if err != nil {
+		return err
+	}
+	p.Peers = append(p.Peers, peerChanges...)
+
+	// The chains and ipsets that would be created come before the rules in them
+	if bootstrap != nil {
+		bootstrapChanges, err := bootstrap.PlanBootstrap()
+		if err != nil {
+			return err
+		}
+		p.Rules = append(p.Rules, bootstrapChanges...)
+	}
+
+	ruleChanges, err := pf.PlanPortforwarding(peers)
+	if err != nil {
+		return err
+	}
+	p.Rules = append(p.Rules, ruleChanges...)
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(p)
+	}
+
+	return writePlanText(w, p)
+}
+
+var planSymbols = map[string]string{
+	wireguard.ActionAdd:      "+",
+	wireguard.ActionUpdate:   "~",
+	wireguard.ActionRemove:   "-",
+	portforward.ActionInsert: "+",
+	portforward.ActionDelete: "-",
+	portforward.ActionCreate: "+",
+}
+
+func writePlanText(w io.Writer, p Plan) error {
+	counts := make(map[string]int)
+
+	for _, change := range p.Peers {
+		counts[change.Action]++
+		line := fmt.Sprintf("%s %s peer %s %s", planSymbols[change.Action], change.Interface, change.PublicKey, strings.Join(change.AllowedIPs, ","))
+		_, err := fmt.Fprintln(w, strings.TrimSpace(line))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, change := range p.Rules {
+		counts[change.Action]++
+		line := fmt.Sprintf("%s %s %s %s %s", planSymbols[change.Action], change.Protocol, change.Table, change.Chain, change.Rule)
+		_, err := fmt.Fprintln(w, strings.TrimSpace(line))
+		if err != nil {
+			return err
+		}
+	}
+
+	summary := fmt.Sprintf("Plan: %d peers to add, %d to update, %d to remove. %d rules to insert, %d to delete.",
+		counts[wireguard.ActionAdd], counts[wireguard.ActionUpdate], counts[wireguard.ActionRemove],
+		counts[portforward.ActionInsert], counts[portforward.ActionDelete])
+
+	// Only bootstrapping creates chains and ipsets
+	if counts[portforward.ActionCreate] > 0 {
+		summary += fmt.Sprintf(" %d chains and ipsets to create.", counts[portforward.ActionCreate])
+	}
+
+	_, err := fmt.Fprintln(w, summary)
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/wireguard"
+)
+
+var planPubkey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+
+// Serve a valid and an invalid peer, and plan against an empty in-memory interface and iptables
+func setupPlan(t *testing.T) {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.WireguardPeerList{
+			{IPv4: "10.99.0.1/32", IPv6: "fc00:bbbb:bbbb:bb01::1/128", Ports: []int{1234}, Pubkey: planPubkey},
+			{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: "invalid"},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	a = &api.API{BaseURL: server.URL, Client: server.Client()}
+
+	var err error
+	wg, err = wireguard.NewWithDevice(wireguard.NewMemoryDevice("wg0"), []string{"wg0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		for _, chain := range portforward.ChainNames("PORTFORWARDING") {
+			if err := ipt.NewChain("nat", chain); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	pf, err = portforward.NewWithIPTables(ipts[0], ipts[1], "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bootstrap = nil
+}
+
+func TestPlanText(t *testing.T) {
+	setupPlan(t)
+
+	var buf bytes.Buffer
+	err := plan(&buf, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"+ wg0 peer " + planPubkey + " 10.99.0.1/32,fc00:bbbb:bbbb:bb01::1/128",
+		"+ ipv4 nat PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1",
+		"+ ipv6 nat PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+		"+ ipv4 nat PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1",
+		"+ ipv6 nat PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+		"Plan: 1 peers to add, 0 to update, 0 to remove. 4 rules to insert, 0 to delete.",
+		"",
+	}, "\n")
+
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("unexpected plan (-want +got):\n%s", diff)
+	}
+}
+
+func TestPlanJSON(t *testing.T) {
+	setupPlan(t)
+
+	var buf bytes.Buffer
+	err := plan(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Plan
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := func(protocol string, chain string, rule string) portforward.RuleChange {
+		return portforward.RuleChange{Protocol: protocol, Table: "nat", Chain: chain, Action: portforward.ActionInsert, Rule: rule}
+	}
+
+	want := Plan{
+		Peers: []wireguard.PeerChange{
+			{Interface: "wg0", Action: wireguard.ActionAdd, PublicKey: planPubkey, AllowedIPs: []string{"10.99.0.1/32", "fc00:bbbb:bbbb:bb01::1/128"}},
+		},
+		Rules: []portforward.RuleChange{
+			rule("ipv4", "PORTFORWARDING_TCP", "-p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1"),
+			rule("ipv6", "PORTFORWARDING_TCP", "-p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1"),
+			rule("ipv4", "PORTFORWARDING_UDP", "-p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1"),
+			rule("ipv6", "PORTFORWARDING_UDP", "-p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1"),
+		},
+	}
+
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreUnexported(wireguard.PeerChange{}, portforward.RuleChange{})); diff != "" {
+		t.Fatalf("unexpected plan (-want +got):\n%s", diff)
+	}
+}
+
+func TestPlanBootstrap(t *testing.T) {
+	setupPlan(t)
+
+	// Only the built-in chain exists, and only the ipv4 ipset
+	var ipts []portforward.IPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		if err := ipt.NewChain("nat", "PREROUTING"); err != nil {
+			t.Fatal(err)
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	ipsets := portforward.NewMemoryIPSets()
+	if err := ipsets.CreateSet("PORTFORWARDING_IPV4", iptables.ProtocolIPv4); err != nil {
+		t.Fatal(err)
+	}
+
+	var err error
+	bootstrap, err = portforward.NewBootstrappedForPlanWithIPTables(ipts[0], ipts[1], ipsets, "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf = bootstrap
+
+	var buf bytes.Buffer
+	err = plan(&buf, "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"+ wg0 peer " + planPubkey + " 10.99.0.1/32,fc00:bbbb:bbbb:bb01::1/128",
+		"+ ipv4 nat PORTFORWARDING_TCP",
+		"+ ipv4 nat PREROUTING -p tcp -j PORTFORWARDING_TCP",
+		"+ ipv4 nat PORTFORWARDING_UDP",
+		"+ ipv4 nat PREROUTING -p udp -j PORTFORWARDING_UDP",
+		"+ ipv6 nat PORTFORWARDING_TCP",
+		"+ ipv6 nat PREROUTING -p tcp -j PORTFORWARDING_TCP",
+		"+ ipv6 nat PORTFORWARDING_UDP",
+		"+ ipv6 nat PREROUTING -p udp -j PORTFORWARDING_UDP",
+		"+ ipv6 ipset PORTFORWARDING_IPV6",
+		"+ ipv4 nat PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1",
+		"+ ipv6 nat PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+		"+ ipv4 nat PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1",
+		"+ ipv6 nat PORTFORWARDING_UDP -p udp -m set --match-set PORTFORWARDING_IPV6 dst -m multiport --dports 1234 -j DNAT --to-destination fc00:bbbb:bbbb:bb01::1",
+		"Plan: 1 peers to add, 0 to update, 0 to remove. 8 rules to insert, 0 to delete. 5 chains and ipsets to create.",
+		"",
+	}, "\n")
+
+	if diff := cmp.Diff(want, buf.String()); diff != "" {
+		t.Fatalf("unexpected plan (-want +got):\n%s", diff)
+	}
+
+	// Planning created nothing
+	for _, ipt := range ipts {
+		chains, err := ipt.ListChains("nat")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"PREROUTING"}, chains); diff != "" {
+			t.Fatalf("chains were created (-want +got):\n%s", diff)
+		}
+	}
+
+	sets, err := ipsets.ListSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sets) != 1 {
+		t.Fatalf("ipsets were created %v", sets)
+	}
+}
+
+func TestPlanUnknownFormat(t *testing.T) {
+	setupPlan(t)
+
+	err := plan(&bytes.Buffer{}, "yaml")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,166 @@
+package portforward
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/mullvad/wg-manager/iputil"
+)
+
+// ExitAddresses keeps the sets of exit addresses matched by the portforwarding rules filled with the addresses of the relay
+// The addresses are the configured ones, along with the public addresses found on the configured interfaces
+type ExitAddresses struct {
+	// InterfaceAddresses returns the addresses of a network interface, it can be replaced for testing
+	InterfaceAddresses func(name string) ([]net.IP, error)
+
+	sets       AddressSets
+	setIPv4    string
+	setIPv6    string
+	addresses  []net.IP
+	interfaces []string
+}
+
+// NewExitAddresses returns a new ExitAddresses, which fills the given sets with the given addresses and the public addresses of the given interfaces
+func NewExitAddresses(sets AddressSets, setIPv4 string, setIPv6 string, addresses []net.IP, interfaces []string) *ExitAddresses {
+	return &ExitAddresses{
+		InterfaceAddresses: interfaceAddresses,
+		sets:               sets,
+		setIPv4:            setIPv4,
+		setIPv6:            setIPv6,
+		addresses:          addresses,
+		interfaces:         interfaces,
+	}
+}
+
+// ParseAddresses parses a list of exit addresses
+func ParseAddresses(addresses []string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid exit address %s", address)
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+func interfaceAddresses(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+
+	return ips, nil
+}
+
+// Addresses returns the exit addresses of the relay, by the set they belong in
+func (e *ExitAddresses) Addresses() (map[string][]net.IP, error) {
+	addresses := append([]net.IP{}, e.addresses...)
+	for _, name := range e.interfaces {
+		ips, err := e.InterfaceAddresses(name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting the addresses of %s %s", name, err.Error())
+		}
+
+		for _, ip := range ips {
+			if iputil.IsPublic(ip) {
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+
+	sets := map[string][]net.IP{
+		e.setIPv4: {},
+		e.setIPv6: {},
+	}
+	for _, address := range addresses {
+		if address.To4() != nil {
+			sets[e.setIPv4] = append(sets[e.setIPv4], address)
+		} else {
+			sets[e.setIPv6] = append(sets[e.setIPv6], address)
+		}
+	}
+
+	return sets, nil
+}
+
+// Update adds the exit addresses missing from the sets, and then removes the addresses that aren't exit addresses anymore
+// Adding first keeps the sets from being left without an exit address while one is replaced by another
+// The sets are left as they are if the addresses of an interface can't be found, rather than being emptied
+func (e *ExitAddresses) Update() error {
+	sets, err := e.Addresses()
+	if err != nil {
+		return err
+	}
+
+	for name, addresses := range sets {
+		current, err := e.sets.ListAddresses(name)
+		if err != nil {
+			return fmt.Errorf("error listing the addresses of %s %s", name, err.Error())
+		}
+
+		added, removed := diffAddresses(current, addresses)
+
+		if len(added) > 0 {
+			log.Printf("adding exit addresses %v to %s", added, name)
+			err = e.sets.AddAddresses(name, added)
+			if err != nil {
+				return fmt.Errorf("error adding exit addresses to %s %s", name, err.Error())
+			}
+		}
+
+		if len(removed) > 0 {
+			log.Printf("removing exit addresses %v from %s", removed, name)
+			err = e.sets.DeleteAddresses(name, removed)
+			if err != nil {
+				return fmt.Errorf("error removing exit addresses from %s %s", name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Return the addresses to add and remove to go from the current addresses to the desired ones
+func diffAddresses(current []net.IP, desired []net.IP) ([]net.IP, []net.IP) {
+	currentSet := make(map[string]bool)
+	for _, address := range current {
+		currentSet[address.String()] = true
+	}
+
+	desiredSet := make(map[string]bool)
+	var added []net.IP
+	for _, address := range desired {
+		key := address.String()
+		if !currentSet[key] && !desiredSet[key] {
+			added = append(added, address)
+		}
+
+		desiredSet[key] = true
+	}
+
+	var removed []net.IP
+	for _, address := range current {
+		if !desiredSet[address.String()] {
+			removed = append(removed, address)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,207 @@
+package portforward_test
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mullvad/wg-manager/portforward"
+)
+
+func newMemoryIPSets(t *testing.T) *portforward.MemoryIPSets {
+	t.Helper()
+
+	ipsets := portforward.NewMemoryIPSets()
+	if err := ipsets.CreateSet(ipsetIPv4, iptables.ProtocolIPv4); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipsets.CreateSet(ipsetIPv6, iptables.ProtocolIPv6); err != nil {
+		t.Fatal(err)
+	}
+
+	return ipsets
+}
+
+func listAddresses(t *testing.T, ipsets *portforward.MemoryIPSets) []string {
+	t.Helper()
+
+	list := []string{}
+	for _, name := range []string{ipsetIPv4, ipsetIPv6} {
+		addresses, err := ipsets.ListAddresses(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, address := range addresses {
+			list = append(list, name+" "+address.String())
+		}
+	}
+
+	return list
+}
+
+func TestExitAddresses(t *testing.T) {
+	ipsets := newMemoryIPSets(t)
+
+	interfaceAddresses := map[string][]net.IP{
+		"eth0": {
+			net.ParseIP("185.65.134.2"),
+			net.ParseIP("10.0.0.1"),
+			net.ParseIP("2a03:1b20:1:f011::2"),
+			net.ParseIP("fe80::1"),
+		},
+	}
+
+	configured, err := portforward.ParseAddresses([]string{"185.65.134.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := portforward.NewExitAddresses(ipsets, ipsetIPv4, ipsetIPv6, configured, []string{"eth0"})
+	e.InterfaceAddresses = func(name string) ([]net.IP, error) {
+		addresses, ok := interfaceAddresses[name]
+		if !ok {
+			return nil, errors.New("no such network interface")
+		}
+
+		return addresses, nil
+	}
+
+	t.Run("fill", func(t *testing.T) {
+		if err := e.Update(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the public addresses of the interface are exit addresses
+		want := []string{
+			"PORTFORWARDING_IPV4 185.65.134.1",
+			"PORTFORWARDING_IPV4 185.65.134.2",
+			"PORTFORWARDING_IPV6 2a03:1b20:1:f011::2",
+		}
+		if diff := cmp.Diff(want, listAddresses(t, ipsets), cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("addresses change", func(t *testing.T) {
+		interfaceAddresses["eth0"] = []net.IP{net.ParseIP("185.65.134.3")}
+
+		if err := e.Update(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{
+			"PORTFORWARDING_IPV4 185.65.134.1",
+			"PORTFORWARDING_IPV4 185.65.134.3",
+		}
+		if diff := cmp.Diff(want, listAddresses(t, ipsets), cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("missing interface", func(t *testing.T) {
+		delete(interfaceAddresses, "eth0")
+
+		if err := e.Update(); err == nil {
+			t.Fatal("no error")
+		}
+
+		// The sets are kept as they were
+		want := []string{
+			"PORTFORWARDING_IPV4 185.65.134.1",
+			"PORTFORWARDING_IPV4 185.65.134.3",
+		}
+		if diff := cmp.Diff(want, listAddresses(t, ipsets), cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// Records the changes made to the sets, in order
+type recordingSets struct {
+	*portforward.MemoryIPSets
+	changes []string
+}
+
+func (r *recordingSets) AddAddresses(name string, addresses []net.IP) error {
+	for _, address := range addresses {
+		r.changes = append(r.changes, "add "+name+" "+address.String())
+	}
+
+	return r.MemoryIPSets.AddAddresses(name, addresses)
+}
+
+func (r *recordingSets) DeleteAddresses(name string, addresses []net.IP) error {
+	for _, address := range addresses {
+		r.changes = append(r.changes, "delete "+name+" "+address.String())
+	}
+
+	return r.MemoryIPSets.DeleteAddresses(name, addresses)
+}
+
+func TestExitAddressesReplaced(t *testing.T) {
+	sets := &recordingSets{MemoryIPSets: newMemoryIPSets(t)}
+	address := net.ParseIP("185.65.134.2")
+
+	e := portforward.NewExitAddresses(sets, ipsetIPv4, ipsetIPv6, nil, []string{"eth0"})
+	e.InterfaceAddresses = func(name string) ([]net.IP, error) {
+		return []net.IP{address}, nil
+	}
+
+	if err := e.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	address = net.ParseIP("185.65.134.3")
+	sets.changes = nil
+
+	if err := e.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new address is added first, so that the set always contains an exit address
+	want := []string{
+		"add PORTFORWARDING_IPV4 185.65.134.3",
+		"delete PORTFORWARDING_IPV4 185.65.134.2",
+	}
+	if diff := cmp.Diff(want, sets.changes); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+}
+
+func TestExitAddressesRefilled(t *testing.T) {
+	ipsets := newMemoryIPSets(t)
+
+	configured, err := portforward.ParseAddresses([]string{"185.65.134.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := portforward.NewExitAddresses(ipsets, ipsetIPv4, ipsetIPv6, configured, nil)
+	if err := e.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another tool empties the set
+	if err := ipsets.DeleteAddresses(ipsetIPv4, configured); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"PORTFORWARDING_IPV4 185.65.134.1"}
+	if diff := cmp.Diff(want, listAddresses(t, ipsets)); diff != "" {
+		t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseAddressesInvalid(t *testing.T) {
+	if _, err := portforward.ParseAddresses([]string{"185.65.134.1", "not-an-address"}); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,293 @@
+package portforward
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/digineo/go-ipset/v2"
+	"github.com/mdlayher/netlink"
+	"github.com/ti-mo/netfilter"
+)
+
+// Type of the ipsets used for portforwarding, matching single addresses
+const ipsetType = "hash:ip"
+
+// AddressSets are named sets of addresses, such as the exit addresses matched by the portforwarding rules
+// It is implemented by the IPSets, and by NFTables for its sets of exit addresses
+type AddressSets interface {
+	// ListAddresses returns the addresses in a set
+	ListAddresses(name string) ([]net.IP, error)
+	// AddAddresses adds addresses to a set
+	AddAddresses(name string, addresses []net.IP) error
+	// DeleteAddresses removes addresses from a set
+	DeleteAddresses(name string, addresses []net.IP) error
+}
+
+// IPSets is the set of ipset operations used for portforwarding
+// It is implemented by SystemIPSets, and by MemoryIPSets for testing without a kernel
+type IPSets interface {
+	AddressSets
+
+	// ListSets returns the protocol of the addresses in each ipset, by name
+	ListSets() (map[string]iptables.Protocol, error)
+	// CreateSet creates an ipset for addresses of the given protocol
+	CreateSet(name string, protocol iptables.Protocol) error
+}
+
+// SystemIPSets manages the ipsets of the system through netlink
+type SystemIPSets struct{}
+
+// NewSystemIPSets returns a new SystemIPSets
+func NewSystemIPSets() *SystemIPSets {
+	return &SystemIPSets{}
+}
+
+// ListSets returns the protocol of the addresses in each ipset, by name
+func (s *SystemIPSets) ListSets() (map[string]iptables.Protocol, error) {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	policies, err := conn.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	sets := make(map[string]iptables.Protocol)
+	for _, policy := range policies {
+		protocol := iptables.ProtocolIPv4
+		if netfilter.ProtoFamily(policy.Family.Get()) == netfilter.ProtoIPv6 {
+			protocol = iptables.ProtocolIPv6
+		}
+
+		sets[policy.Name.Get()] = protocol
+	}
+
+	return sets, nil
+}
+
+// CreateSet creates a hash:ip ipset for addresses of the given protocol, using the newest revision of the type supported by the kernel
+func (s *SystemIPSets) CreateSet(name string, protocol iptables.Protocol) error {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	family := ipsetFamily(protocol)
+
+	setType, err := conn.Type(ipsetType, family)
+	if err != nil {
+		return fmt.Errorf("error getting the revision of %s %s", ipsetType, err.Error())
+	}
+
+	return conn.Create(name, ipsetType, setType.Revision.Get(), family)
+}
+
+// ListAddresses returns the addresses in an ipset
+func (s *SystemIPSets) ListAddresses(name string) ([]net.IP, error) {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	policies, err := conn.ListAll()
+	if err != nil {
+		return nil, err
+	}
+
+	// Large sets are split over several messages with the same name
+	found := false
+	var addresses []net.IP
+	for _, policy := range policies {
+		if policy.Name.Get() != name {
+			continue
+		}
+
+		found = true
+		for _, entry := range policy.Entries {
+			if ip := entry.IP.Get(); ip != nil {
+				addresses = append(addresses, ip)
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("an ipset named %s does not exist", name)
+	}
+
+	return addresses, nil
+}
+
+// AddAddresses adds addresses to an ipset
+func (s *SystemIPSets) AddAddresses(name string, addresses []net.IP) error {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Add(name, ipsetEntries(addresses)...)
+}
+
+// DeleteAddresses removes addresses from an ipset
+func (s *SystemIPSets) DeleteAddresses(name string, addresses []net.IP) error {
+	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Delete(name, ipsetEntries(addresses)...)
+}
+
+func ipsetEntries(addresses []net.IP) []*ipset.Entry {
+	var entries []*ipset.Entry
+	for _, address := range addresses {
+		entries = append(entries, ipset.NewEntry(ipset.EntryIP(address)))
+	}
+
+	return entries
+}
+
+func ipsetFamily(protocol iptables.Protocol) netfilter.ProtoFamily {
+	if protocol == iptables.ProtocolIPv6 {
+		return netfilter.ProtoIPv6
+	}
+
+	return netfilter.ProtoIPv4
+}
+
+// MemoryIPSets is an in-memory implementation of IPSets
+type MemoryIPSets struct {
+	mu        sync.Mutex
+	sets      map[string]iptables.Protocol
+	addresses map[string]map[string]net.IP
+}
+
+// NewMemoryIPSets returns a new MemoryIPSets, without any ipsets
+func NewMemoryIPSets() *MemoryIPSets {
+	return &MemoryIPSets{
+		sets:      make(map[string]iptables.Protocol),
+		addresses: make(map[string]map[string]net.IP),
+	}
+}
+
+// ListSets returns the protocol of the addresses in each ipset, by name
+func (m *MemoryIPSets) ListSets() (map[string]iptables.Protocol, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sets := make(map[string]iptables.Protocol)
+	for name, protocol := range m.sets {
+		sets[name] = protocol
+	}
+
+	return sets, nil
+}
+
+// CreateSet creates an ipset for addresses of the given protocol
+func (m *MemoryIPSets) CreateSet(name string, protocol iptables.Protocol) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sets[name]; ok {
+		return fmt.Errorf("an ipset named %s already exists", name)
+	}
+
+	m.sets[name] = protocol
+	m.addresses[name] = make(map[string]net.IP)
+
+	return nil
+}
+
+// DestroySet removes an ipset, like another tool cleaning up behind our back
+func (m *MemoryIPSets) DestroySet(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sets, name)
+	delete(m.addresses, name)
+}
+
+// ListAddresses returns the addresses in an ipset
+func (m *MemoryIPSets) ListAddresses(name string) ([]net.IP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IP
+	for _, address := range set {
+		addresses = append(addresses, address)
+	}
+
+	return addresses, nil
+}
+
+// AddAddresses adds addresses of the ipset's protocol to an ipset, failing for addresses that are already in it
+func (m *MemoryIPSets) AddAddresses(name string, addresses []net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		if (address.To4() != nil) != (m.sets[name] == iptables.ProtocolIPv4) {
+			return fmt.Errorf("the address %s is for the wrong protocol for ipset %s", address, name)
+		}
+
+		if _, ok := set[address.String()]; ok {
+			return fmt.Errorf("the address %s is already in ipset %s", address, name)
+		}
+	}
+
+	for _, address := range addresses {
+		set[address.String()] = address
+	}
+
+	return nil
+}
+
+// DeleteAddresses removes addresses from an ipset, failing for addresses that aren't in it
+func (m *MemoryIPSets) DeleteAddresses(name string, addresses []net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		if _, ok := set[address.String()]; !ok {
+			return fmt.Errorf("the address %s is not in ipset %s", address, name)
+		}
+	}
+
+	for _, address := range addresses {
+		delete(set, address.String())
+	}
+
+	return nil
+}
+
+func (m *MemoryIPSets) lookup(name string) (map[string]net.IP, error) {
+	set, ok := m.addresses[name]
+	if !ok {
+		return nil, fmt.Errorf("an ipset named %s does not exist", name)
+	}
+
+	return set, nil
+}
@@ -0,0 +1,289 @@
+package portforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// MemoryIPTables is an in-memory implementation of IPTables, which keeps the rules of each chain in a slice
+// If Log is set, every rule change is written to it as a JSON object on a separate line
+type MemoryIPTables struct {
+	Log io.Writer
+
+	mu       sync.Mutex
+	protocol iptables.Protocol
+	tables   map[string]map[string][]string
+}
+
+// NewMemoryIPTables returns a new MemoryIPTables for the given protocol, without any chains
+func NewMemoryIPTables(protocol iptables.Protocol) *MemoryIPTables {
+	return &MemoryIPTables{
+		protocol: protocol,
+		tables:   make(map[string]map[string][]string),
+	}
+}
+
+// NewChain creates a new empty chain in the given table
+func (m *MemoryIPTables) NewChain(table, chain string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tables[table]; !ok {
+		m.tables[table] = make(map[string][]string)
+	}
+
+	if _, ok := m.tables[table][chain]; ok {
+		return fmt.Errorf("chain %s already exists in table %s", chain, table)
+	}
+
+	m.tables[table][chain] = []string{}
+
+	return nil
+}
+
+// ListChains returns the names of the chains in the given table
+func (m *MemoryIPTables) ListChains(table string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var chains []string
+	for chain := range m.tables[table] {
+		chains = append(chains, chain)
+	}
+
+	return chains, nil
+}
+
+// List returns the rules of the given chain, in the same format as iptables -S
+func (m *MemoryIPTables) List(table, chain string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rules, err := m.lookup(table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	list := []string{"-N " + chain}
+	for _, rule := range rules {
+		list = append(list, fmt.Sprintf("-A %s %s", chain, rule))
+	}
+
+	return list, nil
+}
+
+// Insert inserts a rule at the given position of the chain, starting from 1
+func (m *MemoryIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rule := strings.Join(rulespec, " ")
+	err := m.insert(table, chain, pos, rule)
+	if err != nil {
+		return err
+	}
+
+	m.log(table, chain, ActionInsert, rule)
+
+	return nil
+}
+
+// Delete removes the first rule matching the rulespec from the chain
+func (m *MemoryIPTables) Delete(table, chain string, rulespec ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rule := strings.Join(rulespec, " ")
+	err := m.delete(table, chain, rule)
+	if err != nil {
+		return err
+	}
+
+	m.log(table, chain, ActionDelete, rule)
+
+	return nil
+}
+
+// Restore applies the given -N, -I, -D, -F and -A commands to the table as one transaction, like iptables-restore --noflush
+// If any of the commands fail, none of them are applied
+// Only the net changes to the rules of each chain are logged, so that refilling a chain with the same rules logs nothing
+func (m *MemoryIPTables) Restore(table string, commands []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Keep a copy of the table to roll back to
+	backup := make(map[string][]string)
+	for chain, rules := range m.tables[table] {
+		backup[chain] = append([]string{}, rules...)
+	}
+
+	for _, command := range commands {
+		err := m.restoreCommand(table, command)
+		if err != nil {
+			m.tables[table] = backup
+			return err
+		}
+	}
+
+	var chains []string
+	for chain := range m.tables[table] {
+		chains = append(chains, chain)
+	}
+	sort.Strings(chains)
+
+	for _, chain := range chains {
+		m.logChanges(table, chain, backup[chain], m.tables[table][chain])
+	}
+
+	return nil
+}
+
+func (m *MemoryIPTables) restoreCommand(table string, command string) error {
+	fields := strings.Split(command, " ")
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid command %s", command)
+	}
+
+	chain := fields[1]
+	switch fields[0] {
+	case "-N":
+		if _, ok := m.tables[table]; !ok {
+			m.tables[table] = make(map[string][]string)
+		}
+
+		if _, ok := m.tables[table][chain]; ok {
+			return fmt.Errorf("chain %s already exists in table %s", chain, table)
+		}
+
+		m.tables[table][chain] = []string{}
+		return nil
+	case "-F":
+		if _, err := m.lookup(table, chain); err != nil {
+			return err
+		}
+
+		m.tables[table][chain] = []string{}
+		return nil
+	}
+
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid command %s", command)
+	}
+
+	switch fields[0] {
+	case "-I":
+		// The position is optional, and defaults to the start of the chain
+		pos := 1
+		if p, err := strconv.Atoi(fields[2]); err == nil {
+			pos = p
+			fields = fields[1:]
+		}
+
+		return m.insert(table, chain, pos, strings.Join(fields[2:], " "))
+	case "-A":
+		rules, err := m.lookup(table, chain)
+		if err != nil {
+			return err
+		}
+
+		return m.insert(table, chain, len(rules)+1, strings.Join(fields[2:], " "))
+	case "-D":
+		return m.delete(table, chain, strings.Join(fields[2:], " "))
+	default:
+		return fmt.Errorf("unsupported command %s", command)
+	}
+}
+
+// Log the rules that were removed from and added to a chain
+func (m *MemoryIPTables) logChanges(table, chain string, before, after []string) {
+	count := make(map[string]int)
+	for _, rule := range before {
+		count[rule]++
+	}
+
+	var inserted []string
+	for _, rule := range after {
+		if count[rule] > 0 {
+			count[rule]--
+			continue
+		}
+
+		inserted = append(inserted, rule)
+	}
+
+	for _, rule := range before {
+		if count[rule] > 0 {
+			count[rule]--
+			m.log(table, chain, ActionDelete, rule)
+		}
+	}
+
+	for _, rule := range inserted {
+		m.log(table, chain, ActionInsert, rule)
+	}
+}
+
+func (m *MemoryIPTables) insert(table, chain string, pos int, rule string) error {
+	rules, err := m.lookup(table, chain)
+	if err != nil {
+		return err
+	}
+
+	if pos < 1 || pos > len(rules)+1 {
+		return fmt.Errorf("index of insertion %d is out of range for chain %s", pos, chain)
+	}
+
+	rules = append(rules, "")
+	copy(rules[pos:], rules[pos-1:])
+	rules[pos-1] = rule
+	m.tables[table][chain] = rules
+
+	return nil
+}
+
+func (m *MemoryIPTables) delete(table, chain string, rule string) error {
+	rules, err := m.lookup(table, chain)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range rules {
+		if r == rule {
+			m.tables[table][chain] = append(rules[:i], rules[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("bad rule (does a matching rule exist in that chain?)")
+}
+
+func (m *MemoryIPTables) lookup(table, chain string) ([]string, error) {
+	rules, ok := m.tables[table][chain]
+	if !ok {
+		return nil, fmt.Errorf("chain %s does not exist in table %s", chain, table)
+	}
+
+	return rules, nil
+}
+
+func (m *MemoryIPTables) log(table, chain, action, rule string) {
+	if m.Log == nil {
+		return
+	}
+
+	json.NewEncoder(m.Log).Encode(struct {
+		Time time.Time `json:"time"`
+		RuleChange
+	}{
+		Time:       time.Now(),
+		RuleChange: newRuleChange(m.protocol, table, chain, action, rule),
+	})
+}
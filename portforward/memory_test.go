@@ -0,0 +1,849 @@
+package portforward_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+)
+
+// Tests for the portforwarding logic using in-memory iptables, these run in short mode
+
+func newMemoryPortforward(t *testing.T) (*portforward.Portforward, []*portforward.MemoryIPTables) {
+	t.Helper()
+
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		for _, chain := range portforward.ChainNames(chainPrefix) {
+			if err := ipt.NewChain(table, chain); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	pf, err := portforward.NewWithIPTables(ipts[0], ipts[1], chainPrefix, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pf, ipts
+}
+
+func getMemoryRules(t *testing.T, ipts []*portforward.MemoryIPTables) []string {
+	t.Helper()
+
+	rules := []string{}
+	for _, ipt := range ipts {
+		for _, chain := range chains {
+			listRules, err := ipt.List(table, chain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules = append(rules, listRules[1:]...)
+		}
+	}
+
+	return rules
+}
+
+func TestMemoryPortforward(t *testing.T) {
+	pf, ipts := newMemoryPortforward(t)
+
+	t.Run("add rules", func(t *testing.T) {
+		pf.UpdatePortforwarding(apiFixture)
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("remove rules", func(t *testing.T) {
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("add and remove rules for single peer", func(t *testing.T) {
+		pf.AddPortforwarding(apiFixture[0])
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		pf.RemovePortforwarding(apiFixture[0])
+
+		rules = getMemoryRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("update rules for single peer", func(t *testing.T) {
+		pf.AddPortforwarding(apiFixture[0])
+
+		updatedFixture := apiFixture[0]
+		updatedFixture.Ports = rulesUpdatedPortsFixture
+
+		pf.UpdateSinglePeerPortforwarding(updatedFixture)
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff(rulesUpdatedFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMemoryUpdatePortforwardingRestore(t *testing.T) {
+	pf, ipts := newMemoryPortforward(t)
+
+	var buf bytes.Buffer
+	ipts[0].Log = &buf
+
+	peers := append(api.WireguardPeerList{}, apiFixture...)
+	second := apiFixture[0]
+	second.IPv4 = "10.99.0.2/32"
+	second.IPv6 = "fc00:bbbb:bbbb:bb01::2/128"
+	peers = append(peers, second)
+
+	pf.UpdatePortforwarding(peers)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected one line per ipv4 rule, got %q", buf.String())
+	}
+
+	// The chains are filled in the same order every time
+	rules, err := ipts[0].List(table, "PORTFORWARDING_TCP")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"-N PORTFORWARDING_TCP",
+		"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.1",
+		"-A PORTFORWARDING_TCP -p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234,4321 -j DNAT --to-destination 10.99.0.2",
+	}
+	if diff := cmp.Diff(want, rules); diff != "" {
+		t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+	}
+
+	// Refilling the chains with the same rules changes nothing
+	buf.Reset()
+	pf.UpdatePortforwarding(peers)
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected no changes, got %q", buf.String())
+	}
+}
+
+func TestMemoryIPTablesLog(t *testing.T) {
+	pf, ipts := newMemoryPortforward(t)
+
+	var buf bytes.Buffer
+	ipts[0].Log = &buf
+
+	pf.AddPortforwarding(apiFixture[0])
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per ipv4 rule, got %q", buf.String())
+	}
+
+	if !strings.Contains(lines[0], `"action":"insert"`) || !strings.Contains(lines[0], `"protocol":"ipv4"`) {
+		t.Fatalf("unexpected log line %s", lines[0])
+	}
+}
+
+func TestMemoryMissingChain(t *testing.T) {
+	ipt := portforward.NewMemoryIPTables(iptables.ProtocolIPv4)
+
+	_, err := portforward.NewWithIPTables(ipt, ipt, chainPrefix, ipsetIPv4, ipsetIPv6, "se-got")
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestMemoryPlanPortforwarding(t *testing.T) {
+	pf, ipts := newMemoryPortforward(t)
+	pf.AddPortforwarding(apiFixture[0])
+
+	updatedFixture := apiFixture[0]
+	updatedFixture.Ports = []int{1234}
+
+	changes, err := pf.PlanPortforwarding(api.WireguardPeerList{updatedFixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 8 {
+		t.Fatalf("expected an insert and a delete per chain and protocol, got %+v", changes)
+	}
+
+	want := portforward.RuleChange{
+		Protocol: "ipv4",
+		Table:    table,
+		Chain:    "PORTFORWARDING_TCP",
+		Action:   portforward.ActionInsert,
+		Rule:     "-p tcp -m set --match-set PORTFORWARDING_IPV4 dst -m multiport --dports 1234 -j DNAT --to-destination 10.99.0.1",
+	}
+
+	if diff := cmp.Diff(want, changes[0], cmpopts.IgnoreUnexported(portforward.RuleChange{})); diff != "" {
+		t.Fatalf("unexpected change (-want +got):\n%s", diff)
+	}
+
+	rules := getMemoryRules(t, ipts)
+	if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+		t.Fatalf("plan changed the rules (-want +got):\n%s", diff)
+	}
+}
+
+func TestMemoryApplyBatch(t *testing.T) {
+	pf, ipts := newMemoryPortforward(t)
+
+	var buf bytes.Buffer
+	ipts[0].Log = &buf
+
+	updatedFixture := apiFixture[0]
+	updatedFixture.Ports = rulesUpdatedPortsFixture
+
+	t.Run("add and update in one batch", func(t *testing.T) {
+		batch := portforward.NewBatch()
+		batch.Add(apiFixture[0])
+		batch.Update(updatedFixture)
+
+		if err := pf.ApplyBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff(rulesUpdatedFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		// Only the final rules are inserted
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("expected one line per ipv4 rule, got %q", buf.String())
+		}
+	})
+
+	t.Run("remove in a batch", func(t *testing.T) {
+		batch := portforward.NewBatch()
+		batch.Remove(updatedFixture)
+
+		if err := pf.ApplyBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff([]string{}, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMemoryIPTablesRestoreRollback(t *testing.T) {
+	ipt := portforward.NewMemoryIPTables(iptables.ProtocolIPv4)
+	if err := ipt.NewChain(table, "TEST"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ipt.Restore(table, []string{"-I TEST 1 -j ACCEPT", "-D TEST -j DROP"})
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	rules, err := ipt.List(table, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"-N TEST"}, rules); diff != "" {
+		t.Fatalf("restore was not rolled back (-want +got):\n%s", diff)
+	}
+}
+
+func TestMemoryIPTablesRestoreFlush(t *testing.T) {
+	ipt := portforward.NewMemoryIPTables(iptables.ProtocolIPv4)
+	if err := ipt.NewChain(table, "TEST"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ipt.Restore(table, []string{"-A TEST -j ACCEPT", "-A TEST -j DROP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ipt.Restore(table, []string{"-F TEST", "-A TEST -j DROP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := ipt.List(table, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"-N TEST", "-A TEST -j DROP"}, rules); diff != "" {
+		t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+	}
+
+	// Flushing a missing chain fails the whole transaction
+	err = ipt.Restore(table, []string{"-F TEST", "-F MISSING"})
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	rules, err = ipt.List(table, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"-N TEST", "-A TEST -j DROP"}, rules); diff != "" {
+		t.Fatalf("restore was not rolled back (-want +got):\n%s", diff)
+	}
+}
+
+func TestMemoryBootstrap(t *testing.T) {
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		if err := ipt.NewChain(table, "PREROUTING"); err != nil {
+			t.Fatal(err)
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	ipsets := portforward.NewMemoryIPSets()
+
+	pf, err := portforward.NewBootstrappedWithIPTables(ipts[0], ipts[1], ipsets, chainPrefix, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantPrerouting := []string{
+		"-N PREROUTING",
+		"-A PREROUTING -p tcp -j PORTFORWARDING_TCP",
+		"-A PREROUTING -p udp -j PORTFORWARDING_UDP",
+	}
+
+	wantIPSets := map[string]iptables.Protocol{
+		ipsetIPv4: iptables.ProtocolIPv4,
+		ipsetIPv6: iptables.ProtocolIPv6,
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+
+		for _, ipt := range ipts {
+			prerouting, err := ipt.List(table, "PREROUTING")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(wantPrerouting, prerouting); diff != "" {
+				t.Fatalf("unexpected jump rules (-want +got):\n%s", diff)
+			}
+		}
+
+		sets, err := ipsets.ListSets()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(wantIPSets, sets); diff != "" {
+			t.Fatalf("unexpected ipsets (-want +got):\n%s", diff)
+		}
+	}
+
+	t.Run("create", func(t *testing.T) {
+		check(t)
+
+		pf.UpdatePortforwarding(apiFixture)
+
+		rules := getMemoryRules(t, ipts)
+		if diff := cmp.Diff(rulesFixture, rules, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		// Another tool flushes PREROUTING and removes an ipset
+		if err := ipts[0].Restore(table, []string{"-F PREROUTING"}); err != nil {
+			t.Fatal(err)
+		}
+		ipsets.DestroySet(ipsetIPv6)
+
+		created, err := pf.Bootstrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !created {
+			t.Fatal("nothing was repaired")
+		}
+		check(t)
+
+		// Bootstrapping again when nothing is missing changes nothing
+		created, err = pf.Bootstrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created {
+			t.Fatal("something was repaired")
+		}
+		check(t)
+	})
+
+	t.Run("flushed chain", func(t *testing.T) {
+		// Another tool flushes only a portforwarding chain, leaving the chain and the jump rule to it in place
+		if err := ipts[1].Restore(table, []string{"-F PORTFORWARDING_UDP"}); err != nil {
+			t.Fatal(err)
+		}
+
+		repaired, err := pf.Bootstrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !repaired {
+			t.Fatal("the flushed chain wasn't noticed")
+		}
+
+		// The rules are put back by the next update
+		pf.UpdatePortforwarding(apiFixture)
+
+		repaired, err = pf.Bootstrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repaired {
+			t.Fatal("something was repaired")
+		}
+
+		// Chains that were left empty aren't reported as flushed
+		pf.UpdatePortforwarding(api.WireguardPeerList{})
+
+		repaired, err = pf.Bootstrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if repaired {
+			t.Fatal("an empty chain was reported as flushed")
+		}
+	})
+
+	t.Run("ipset for the wrong protocol", func(t *testing.T) {
+		ipsets.DestroySet(ipsetIPv4)
+		if err := ipsets.CreateSet(ipsetIPv4, iptables.ProtocolIPv6); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := pf.Bootstrap(); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestMemoryBootstrapInvalidLocation(t *testing.T) {
+	ipt := portforward.NewMemoryIPTables(iptables.ProtocolIPv4)
+	if err := ipt.NewChain(table, "PREROUTING"); err != nil {
+		t.Fatal(err)
+	}
+
+	ipsets := portforward.NewMemoryIPSets()
+
+	_, err := portforward.NewBootstrappedWithIPTables(ipt, ipt, ipsets, chainPrefix, ipsetIPv4, ipsetIPv6, "invalid")
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"PREROUTING"}, chains); diff != "" {
+		t.Fatalf("chains were created for an invalid location (-want +got):\n%s", diff)
+	}
+
+	sets, err := ipsets.ListSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sets) != 0 {
+		t.Fatalf("ipsets were created for an invalid location %v", sets)
+	}
+}
+
+func TestMemoryPlanBootstrap(t *testing.T) {
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		if err := ipt.NewChain(table, "PREROUTING"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ipt.NewChain("filter", "FORWARD"); err != nil {
+			t.Fatal(err)
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	ipsets := portforward.NewMemoryIPSets()
+	if err := ipsets.CreateSet(ipsetIPv4, iptables.ProtocolIPv4); err != nil {
+		t.Fatal(err)
+	}
+
+	pf, err := portforward.NewBootstrappedForPlanWithIPTables(ipts[0], ipts[1], ipsets, chainPrefix, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pf.EnableForwardFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := pf.PlanBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []portforward.RuleChange
+	for _, protocol := range []string{"ipv4", "ipv6"} {
+		want = append(want,
+			portforward.RuleChange{Protocol: protocol, Table: table, Chain: "PORTFORWARDING_TCP", Action: portforward.ActionCreate},
+			portforward.RuleChange{Protocol: protocol, Table: table, Chain: "PREROUTING", Action: portforward.ActionInsert, Rule: "-p tcp -j PORTFORWARDING_TCP"},
+			portforward.RuleChange{Protocol: protocol, Table: table, Chain: "PORTFORWARDING_UDP", Action: portforward.ActionCreate},
+			portforward.RuleChange{Protocol: protocol, Table: table, Chain: "PREROUTING", Action: portforward.ActionInsert, Rule: "-p udp -j PORTFORWARDING_UDP"},
+			portforward.RuleChange{Protocol: protocol, Table: "filter", Chain: "PORTFORWARDING_FORWARD", Action: portforward.ActionCreate},
+			portforward.RuleChange{Protocol: protocol, Table: "filter", Chain: "PORTFORWARDING_FORWARD", Action: portforward.ActionInsert, Rule: "-j DROP"},
+			portforward.RuleChange{Protocol: protocol, Table: "filter", Chain: "FORWARD", Action: portforward.ActionInsert, Rule: "-m conntrack --ctstate DNAT --ctdir ORIGINAL -j PORTFORWARDING_FORWARD"},
+		)
+	}
+	want = append(want, portforward.RuleChange{Protocol: "ipv6", Table: "ipset", Chain: ipsetIPv6, Action: portforward.ActionCreate})
+
+	if diff := cmp.Diff(want, changes, cmpopts.IgnoreUnexported(portforward.RuleChange{})); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	// The rules of the missing chains are planned as if the chains were empty
+	ruleChanges, err := pf.PlanPortforwarding(apiFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ruleChanges) != 8 {
+		t.Fatalf("expected 8 rules to insert, got %+v", ruleChanges)
+	}
+
+	if _, err := pf.Bootstrap(); err == nil {
+		t.Fatal("bootstrapping wasn't disabled")
+	}
+
+	// Nothing was created
+	for _, ipt := range ipts {
+		for tableName, builtin := range map[string]string{table: "PREROUTING", "filter": "FORWARD"} {
+			chains, err := ipt.ListChains(tableName)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff([]string{builtin}, chains); diff != "" {
+				t.Fatalf("chains were created (-want +got):\n%s", diff)
+			}
+
+			rules, err := ipt.List(tableName, builtin)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(rules) != 1 {
+				t.Fatalf("jump rules were added %v", rules)
+			}
+		}
+	}
+
+	sets, err := ipsets.ListSets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sets) != 1 {
+		t.Fatalf("ipsets were created %v", sets)
+	}
+}
+
+func TestMemoryBootstrapDisabled(t *testing.T) {
+	pf, _ := newMemoryPortforward(t)
+
+	if _, err := pf.Bootstrap(); err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestMemoryForwardFilter(t *testing.T) {
+	pf, ipts := newMemoryPortforward(t)
+
+	forwardChain := portforward.ForwardChainName(chainPrefix)
+
+	if err := pf.EnableForwardFilter(); err == nil {
+		t.Fatal("no error for a missing chain")
+	}
+
+	for _, ipt := range ipts {
+		if err := ipt.NewChain("filter", forwardChain); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pf.EnableForwardFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	getForwardRules := func(t *testing.T) []string {
+		t.Helper()
+
+		rules, err := ipts[0].List("filter", forwardChain)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return rules
+	}
+
+	t.Run("update rules", func(t *testing.T) {
+		pf.UpdatePortforwarding(apiFixture)
+
+		want := []string{
+			"-N PORTFORWARDING_FORWARD",
+			"-A PORTFORWARDING_FORWARD -d 10.99.0.1 -p tcp -m multiport --dports 1234,4321 -j ACCEPT",
+			"-A PORTFORWARDING_FORWARD -d 10.99.0.1 -p udp -m multiport --dports 1234,4321 -j ACCEPT",
+			"-A PORTFORWARDING_FORWARD -j DROP",
+		}
+		if diff := cmp.Diff(want, getForwardRules(t)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+
+		changes, err := pf.PlanPortforwarding(apiFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(changes) != 0 {
+			t.Fatalf("expected no changes, got %+v", changes)
+		}
+	})
+
+	t.Run("update rules for single peer", func(t *testing.T) {
+		updatedFixture := apiFixture[0]
+		updatedFixture.Ports = rulesUpdatedPortsFixture
+
+		batch := portforward.NewBatch()
+		batch.Update(updatedFixture)
+		if err := pf.ApplyBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		// The new rules are inserted before the drop rule
+		want := []string{
+			"-N PORTFORWARDING_FORWARD",
+			"-A PORTFORWARDING_FORWARD -d 10.99.0.1 -p tcp -m multiport --dports 1234,1337,4322 -j ACCEPT",
+			"-A PORTFORWARDING_FORWARD -d 10.99.0.1 -p udp -m multiport --dports 1234,1337,4322 -j ACCEPT",
+			"-A PORTFORWARDING_FORWARD -j DROP",
+		}
+		got := getForwardRules(t)
+		if diff := cmp.Diff(want, got, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+		if got[len(got)-1] != "-A PORTFORWARDING_FORWARD -j DROP" {
+			t.Fatalf("the drop rule isn't last in %q", got)
+		}
+
+		pf.UpdateSinglePeerPortforwarding(apiFixture[0])
+
+		want = []string{
+			"-N PORTFORWARDING_FORWARD",
+			"-A PORTFORWARDING_FORWARD -d 10.99.0.1 -p tcp -m multiport --dports 1234,4321 -j ACCEPT",
+			"-A PORTFORWARDING_FORWARD -d 10.99.0.1 -p udp -m multiport --dports 1234,4321 -j ACCEPT",
+			"-A PORTFORWARDING_FORWARD -j DROP",
+		}
+		got = getForwardRules(t)
+		if diff := cmp.Diff(want, got, cmpopts.SortSlices(stringCompare)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+		if got[len(got)-1] != "-A PORTFORWARDING_FORWARD -j DROP" {
+			t.Fatalf("the drop rule isn't last in %q", got)
+		}
+	})
+
+	t.Run("remove rules", func(t *testing.T) {
+		pf.RemovePortforwarding(apiFixture[0])
+
+		want := []string{
+			"-N PORTFORWARDING_FORWARD",
+			"-A PORTFORWARDING_FORWARD -j DROP",
+		}
+		if diff := cmp.Diff(want, getForwardRules(t)); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMemoryBootstrapForwardFilterFirst(t *testing.T) {
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		if err := ipt.NewChain(table, "PREROUTING"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ipt.NewChain("filter", "FORWARD"); err != nil {
+			t.Fatal(err)
+		}
+
+		// FORWARD already accepts the traffic to the tunnel
+		if err := ipt.Restore("filter", []string{"-A FORWARD -o wg0 -j ACCEPT"}); err != nil {
+			t.Fatal(err)
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	pf, err := portforward.NewBootstrappedWithIPTables(ipts[0], ipts[1], portforward.NewMemoryIPSets(), chainPrefix, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pf.EnableForwardFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	jump := "-A FORWARD -m conntrack --ctstate DNAT --ctdir ORIGINAL -j PORTFORWARDING_FORWARD"
+
+	check := func(t *testing.T, want []string) {
+		t.Helper()
+
+		for _, ipt := range ipts {
+			forward, err := ipt.List("filter", "FORWARD")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(want, forward); diff != "" {
+				t.Fatalf("unexpected FORWARD rules (-want +got):\n%s", diff)
+			}
+		}
+	}
+
+	// The jump comes before the existing ACCEPT rule
+	check(t, []string{"-N FORWARD", jump, "-A FORWARD -o wg0 -j ACCEPT"})
+
+	// Another tool inserts a rule at the top of FORWARD
+	established := "-m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"
+	for _, ipt := range ipts {
+		if err := ipt.Restore("filter", []string{"-I FORWARD 1 " + established}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repaired, err := pf.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !repaired {
+		t.Fatal("the jump rule wasn't moved back to the top")
+	}
+
+	check(t, []string{"-N FORWARD", jump, "-A FORWARD " + established, "-A FORWARD -o wg0 -j ACCEPT"})
+
+	repaired, err = pf.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired {
+		t.Fatal("something was repaired")
+	}
+}
+
+func TestMemoryBootstrapForwardFilter(t *testing.T) {
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		if err := ipt.NewChain(table, "PREROUTING"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ipt.NewChain("filter", "FORWARD"); err != nil {
+			t.Fatal(err)
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	pf, err := portforward.NewBootstrappedWithIPTables(ipts[0], ipts[1], portforward.NewMemoryIPSets(), chainPrefix, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pf.EnableForwardFilter(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ipt := range ipts {
+		forward, err := ipt.List("filter", "FORWARD")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"-N FORWARD", "-A FORWARD -m conntrack --ctstate DNAT --ctdir ORIGINAL -j PORTFORWARDING_FORWARD"}
+		if diff := cmp.Diff(want, forward); diff != "" {
+			t.Fatalf("unexpected jump rules (-want +got):\n%s", diff)
+		}
+
+		rules, err := ipt.List("filter", portforward.ForwardChainName(chainPrefix))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want = []string{"-N PORTFORWARDING_FORWARD", "-A PORTFORWARDING_FORWARD -j DROP"}
+		if diff := cmp.Diff(want, rules); diff != "" {
+			t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+		}
+	}
+
+	// Flushing the filter chain removes the drop rule as well
+	if err := ipts[0].Restore("filter", []string{"-F PORTFORWARDING_FORWARD"}); err != nil {
+		t.Fatal(err)
+	}
+
+	repaired, err := pf.Bootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !repaired {
+		t.Fatal("the missing drop rule wasn't added")
+	}
+
+	rules, err := ipts[0].List("filter", portforward.ForwardChainName(chainPrefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"-N PORTFORWARDING_FORWARD", "-A PORTFORWARDING_FORWARD -j DROP"}
+	if diff := cmp.Diff(want, rules); diff != "" {
+		t.Fatalf("unexpected rules (-want +got):\n%s", diff)
+	}
+}
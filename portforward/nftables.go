@@ -0,0 +1,628 @@
+package portforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mullvad/wg-manager/api"
+	"golang.org/x/sys/unix"
+)
+
+// NFTables manages portforwarding with a native nftables table
+// Instead of one DNAT rule per peer, the ports of every peer are kept in one map per address family, from port to peer address,
+// which a single rule per address family and transport protocol looks up the destination in:
+//
+//	table inet <table> {
+//		set <ipset ipv4> { type ipv4_addr }
+//		set <ipset ipv6> { type ipv6_addr }
+//		map portforwarding_ipv4 { type inet_service : ipv4_addr }
+//		map portforwarding_ipv6 { type inet_service : ipv6_addr }
+//		chain prerouting {
+//			type nat hook prerouting priority dstnat
+//			ip daddr @<ipset ipv4> tcp dport dnat ip to tcp dport map @portforwarding_ipv4
+//			...
+//		}
+//	}
+//
+// The sets of exit addresses take the place of the ipsets used with iptables, and are named the same
+type NFTables struct {
+	conn     *nftables.Conn
+	table    *nftables.Table
+	chain    *nftables.Chain
+	maps     map[iptables.Protocol]*nftables.Set
+	sets     map[iptables.Protocol]*nftables.Set
+	location string
+
+	// Set when planning without the table existing, so that every map element is planned as an insert
+	missing bool
+}
+
+// Names of the nftables objects, other than the table and the sets of exit addresses
+const (
+	nftablesChain   = "prerouting"
+	nftablesMapIPv4 = "portforwarding_ipv4"
+	nftablesMapIPv6 = "portforwarding_ipv6"
+)
+
+// An address family of the portforwarding table, and where the destination address is in its network header
+type nftablesFamily struct {
+	protocol iptables.Protocol
+	nfproto  byte
+	addrType nftables.SetDatatype
+	offset   uint32
+	length   uint32
+}
+
+// The destination address is at offset 16 of the ipv4 header, and offset 24 of the ipv6 header
+var nftablesFamilies = []nftablesFamily{
+	{iptables.ProtocolIPv4, unix.NFPROTO_IPV4, nftables.TypeIPAddr, 16, net.IPv4len},
+	{iptables.ProtocolIPv6, unix.NFPROTO_IPV6, nftables.TypeIP6Addr, 24, net.IPv6len},
+}
+
+// NewNFTables validates the location, ensures that the portforwarding table exists with its sets, maps and rules, and returns a new NFTables instance
+func NewNFTables(table string, setIPv4 string, setIPv6 string, location string) (*NFTables, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNFTablesWithConn(conn, table, setIPv4, setIPv6, location)
+}
+
+// NewNFTablesWithConn is like NewNFTables, but uses the given nftables connection, which may be a fake one for testing
+func NewNFTablesWithConn(conn *nftables.Conn, table string, setIPv4 string, setIPv6 string, location string) (*NFTables, error) {
+	err := validateLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	n := newNFTables(conn, table, setIPv4, setIPv6, location)
+
+	err = n.setup()
+	if err != nil {
+		return nil, fmt.Errorf("error setting up nftables table %s: %s", table, err.Error())
+	}
+
+	return n, nil
+}
+
+// NewNFTablesForPlan validates the location and returns a new NFTables instance for PlanPortforwarding, without creating or changing anything
+// If the portforwarding table doesn't exist yet, every map element is planned as an insert
+func NewNFTablesForPlan(table string, setIPv4 string, setIPv6 string, location string) (*NFTables, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewNFTablesForPlanWithConn(conn, table, setIPv4, setIPv6, location)
+}
+
+// NewNFTablesForPlanWithConn is like NewNFTablesForPlan, but uses the given nftables connection, which may be a fake one for testing
+func NewNFTablesForPlanWithConn(conn *nftables.Conn, table string, setIPv4 string, setIPv6 string, location string) (*NFTables, error) {
+	err := validateLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	n := newNFTables(conn, table, setIPv4, setIPv6, location)
+
+	tables, err := conn.ListTablesOfFamily(n.table.Family)
+	if err != nil {
+		return nil, fmt.Errorf("error listing nftables tables %s", err.Error())
+	}
+
+	n.missing = true
+	for _, t := range tables {
+		if t.Name == table {
+			n.missing = false
+		}
+	}
+
+	return n, nil
+}
+
+// Return a new NFTables instance describing the table, sets, maps and chain, without sending anything to the kernel
+func newNFTables(conn *nftables.Conn, table string, setIPv4 string, setIPv6 string, location string) *NFTables {
+	n := &NFTables{
+		conn:     conn,
+		table:    &nftables.Table{Name: table, Family: nftables.TableFamilyINet},
+		maps:     make(map[iptables.Protocol]*nftables.Set),
+		sets:     make(map[iptables.Protocol]*nftables.Set),
+		location: location,
+	}
+
+	n.chain = &nftables.Chain{
+		Name:     nftablesChain,
+		Table:    n.table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	}
+
+	for _, family := range nftablesFamilies {
+		name := setIPv4
+		if family.protocol == iptables.ProtocolIPv6 {
+			name = setIPv6
+		}
+
+		n.sets[family.protocol] = &nftables.Set{
+			Table:   n.table,
+			Name:    name,
+			KeyType: family.addrType,
+		}
+
+		n.maps[family.protocol] = &nftables.Set{
+			Table:    n.table,
+			Name:     nftablesMapName(family.protocol),
+			IsMap:    true,
+			KeyType:  nftables.TypeInetService,
+			DataType: family.addrType,
+		}
+	}
+
+	return n
+}
+
+// Create the table, sets, maps and chain if they don't exist, and replace the rules of the chain, in one transaction
+// Existing elements of the sets and maps are kept
+func (n *NFTables) setup() error {
+	n.conn.AddTable(n.table)
+	n.conn.AddChain(n.chain)
+	n.conn.FlushChain(n.chain)
+
+	for _, family := range nftablesFamilies {
+		set := n.sets[family.protocol]
+		err := n.conn.AddSet(set, nil)
+		if err != nil {
+			return err
+		}
+
+		portMap := n.maps[family.protocol]
+		err = n.conn.AddSet(portMap, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, transportProtocol := range []byte{unix.IPPROTO_TCP, unix.IPPROTO_UDP} {
+			n.conn.AddRule(&nftables.Rule{
+				Table: n.table,
+				Chain: n.chain,
+				Exprs: []expr.Any{
+					&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family.nfproto}},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: family.offset, Len: family.length},
+					&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+					&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{transportProtocol}},
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+					&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: portMap.Name, SetID: portMap.ID},
+					&expr.NAT{Type: expr.NATTypeDestNAT, Family: uint32(family.nfproto), RegAddrMin: 1},
+				},
+			})
+		}
+	}
+
+	return n.conn.Flush()
+}
+
+// The elements of the portforwarding maps, from port to peer address, for each address family
+type nftablesRuleSet struct {
+	n        *NFTables
+	elements map[iptables.Protocol]map[uint16]string
+}
+
+// NewRuleSet returns a new empty RuleSet
+func (n *NFTables) NewRuleSet() RuleSet {
+	return n.newRuleSet()
+}
+
+func (n *NFTables) newRuleSet() *nftablesRuleSet {
+	return &nftablesRuleSet{
+		n: n,
+		elements: map[iptables.Protocol]map[uint16]string{
+			iptables.ProtocolIPv4: make(map[uint16]string),
+			iptables.ProtocolIPv6: make(map[uint16]string),
+		},
+	}
+}
+
+// Add adds the map elements for a peer to the set
+func (s *nftablesRuleSet) Add(peer api.WireguardPeer) {
+	for protocol, elements := range s.n.peerElements(peer) {
+		for port, address := range elements {
+			s.elements[protocol][port] = address
+		}
+	}
+}
+
+// Return the map elements for a peer, with the ports filtered by city
+func (n *NFTables) peerElements(peer api.WireguardPeer) map[iptables.Protocol]map[uint16]string {
+	elements := make(map[iptables.Protocol]map[uint16]string)
+
+	ports := peer.Ports
+	if len(peer.Cities) > 0 {
+		ports = filterPortsByCity(peer, n.location)
+	}
+
+	if len(ports) < 1 {
+		return elements
+	}
+
+	// Ignore ip's with errors, in-case we get bad data from the API
+	for protocol, cidr := range map[iptables.Protocol]string{iptables.ProtocolIPv4: peer.IPv4, iptables.ProtocolIPv6: peer.IPv6} {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+
+		elements[protocol] = make(map[uint16]string)
+		for _, port := range ports {
+			elements[protocol][uint16(port)] = ip.String()
+		}
+	}
+
+	return elements
+}
+
+// UpdatePortforwarding updates the portforwarding maps to match the given list of peers
+func (n *NFTables) UpdatePortforwarding(peers api.WireguardPeerList) {
+	n.UpdateRuleSet(n.mapElements(peers))
+}
+
+func (n *NFTables) mapElements(peers api.WireguardPeerList) *nftablesRuleSet {
+	set := n.newRuleSet()
+	for _, peer := range peers {
+		set.Add(peer)
+	}
+
+	return set
+}
+
+// UpdateRuleSet updates the portforwarding maps to match the given set of rules, in one transaction
+func (n *NFTables) UpdateRuleSet(ruleSet RuleSet) error {
+	set, ok := ruleSet.(*nftablesRuleSet)
+	if !ok {
+		log.Printf("error updating nftables maps, the rule set is for another backend")
+		return errors.New("the rule set is for another backend")
+	}
+
+	changes, err := n.diff(set.elements)
+	if err != nil {
+		log.Printf("error getting current nftables map elements %s", err.Error())
+		return err
+	}
+
+	err = n.apply(changes)
+	if err != nil {
+		log.Printf("error updating nftables maps %s", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// PlanPortforwarding returns the changes UpdatePortforwarding would make to the portforwarding maps for the given list of peers, without applying them
+func (n *NFTables) PlanPortforwarding(peers api.WireguardPeerList) ([]RuleChange, error) {
+	changes, err := n.diff(n.mapElements(peers).elements)
+	if err != nil {
+		return nil, fmt.Errorf("error getting current nftables map elements %s", err.Error())
+	}
+
+	sort.SliceStable(changes, func(i int, j int) bool {
+		if changes[i].Protocol != changes[j].Protocol {
+			return changes[i].Protocol < changes[j].Protocol
+		}
+
+		return changes[i].Rule < changes[j].Rule
+	})
+
+	return changes, nil
+}
+
+// AddPortforwarding adds the map elements for a peer
+func (n *NFTables) AddPortforwarding(peer api.WireguardPeer) {
+	b := NewBatch()
+	b.Add(peer)
+	n.applyBatch(b)
+}
+
+// RemovePortforwarding removes the map elements for a peer
+func (n *NFTables) RemovePortforwarding(peer api.WireguardPeer) {
+	b := NewBatch()
+	b.Remove(peer)
+	n.applyBatch(b)
+}
+
+// UpdateSinglePeerPortforwarding replaces the map elements for the addresses of a peer
+func (n *NFTables) UpdateSinglePeerPortforwarding(peer api.WireguardPeer) {
+	b := NewBatch()
+	b.Update(peer)
+	n.applyBatch(b)
+}
+
+func (n *NFTables) applyBatch(b *Batch) {
+	err := n.ApplyBatch(b)
+	if err != nil {
+		log.Printf("error updating nftables maps %s", err.Error())
+	}
+}
+
+// ApplyBatch applies the changes of a batch in order to the current map elements, and then applies the result in one transaction
+func (n *NFTables) ApplyBatch(b *Batch) error {
+	current, err := n.currentElements()
+	if err != nil {
+		return fmt.Errorf("error getting current nftables map elements %s", err.Error())
+	}
+
+	desired := make(map[iptables.Protocol]map[uint16]string)
+	for protocol, elements := range current {
+		desired[protocol] = make(map[uint16]string)
+		for port, address := range elements {
+			desired[protocol][port] = address
+		}
+	}
+
+	for _, operation := range b.operations {
+		for protocol, elements := range n.peerElements(operation.peer) {
+			applyElementOperation(operation.action, elements, desired[protocol])
+		}
+	}
+
+	return n.apply(diffElements(n.table.Name, current, desired))
+}
+
+// Apply a batch operation for the elements of a peer to the elements of a map
+func applyElementOperation(action string, peerElements map[uint16]string, elements map[uint16]string) {
+	switch action {
+	case batchAdd:
+		for port, address := range peerElements {
+			elements[port] = address
+		}
+	case batchRemove:
+		for port, address := range peerElements {
+			// The port may have been given to another peer since
+			if elements[port] == address {
+				delete(elements, port)
+			}
+		}
+	case batchUpdate:
+		// Remove the other ports of the same address, every element of a peer has the same address
+		for _, address := range peerElements {
+			for port, a := range elements {
+				if a == address {
+					delete(elements, port)
+				}
+			}
+
+			break
+		}
+
+		for port, address := range peerElements {
+			elements[port] = address
+		}
+	}
+}
+
+// Compare the current map elements with the given ones, and return the changes needed to make them match
+func (n *NFTables) diff(elements map[iptables.Protocol]map[uint16]string) ([]RuleChange, error) {
+	current, err := n.currentElements()
+	if err != nil {
+		return nil, err
+	}
+
+	return diffElements(n.table.Name, current, elements), nil
+}
+
+// Return the changes needed to go from the current map elements to the given ones
+// A port that is forwarded to another address is deleted and inserted again, as map elements can't be changed in place
+func diffElements(table string, current map[iptables.Protocol]map[uint16]string, elements map[iptables.Protocol]map[uint16]string) []RuleChange {
+	changes := []RuleChange{}
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		for port, address := range current[protocol] {
+			if elements[protocol][port] != address {
+				changes = append(changes, newRuleChange(protocol, table, nftablesMapName(protocol), ActionDelete, formatElement(port, address)))
+			}
+		}
+
+		for port, address := range elements[protocol] {
+			if current[protocol][port] != address {
+				changes = append(changes, newRuleChange(protocol, table, nftablesMapName(protocol), ActionInsert, formatElement(port, address)))
+			}
+		}
+	}
+
+	return changes
+}
+
+// Apply the changes to the maps in one transaction, with deletions first
+func (n *NFTables) apply(changes []RuleChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	deleted := make(map[iptables.Protocol][]nftables.SetElement)
+	inserted := make(map[iptables.Protocol][]nftables.SetElement)
+	for _, change := range changes {
+		element, err := parseElement(change.Rule)
+		if err != nil {
+			return err
+		}
+
+		switch change.Action {
+		case ActionInsert:
+			inserted[change.protocol] = append(inserted[change.protocol], element)
+		case ActionDelete:
+			deleted[change.protocol] = append(deleted[change.protocol], element)
+		}
+	}
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		if len(deleted[protocol]) > 0 {
+			err := n.conn.SetDeleteElements(n.maps[protocol], deleted[protocol])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		if len(inserted[protocol]) > 0 {
+			err := n.conn.SetAddElements(n.maps[protocol], inserted[protocol])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return n.conn.Flush()
+}
+
+// ListAddresses returns the addresses in one of the sets of exit addresses
+func (n *NFTables) ListAddresses(name string) ([]net.IP, error) {
+	set, err := n.lookupSet(name)
+	if err != nil {
+		return nil, err
+	}
+
+	elements, err := n.conn.GetSetElements(set)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IP
+	for _, element := range elements {
+		addresses = append(addresses, net.IP(element.Key))
+	}
+
+	return addresses, nil
+}
+
+// AddAddresses adds addresses to one of the sets of exit addresses, in one transaction
+func (n *NFTables) AddAddresses(name string, addresses []net.IP) error {
+	set, err := n.lookupSet(name)
+	if err != nil {
+		return err
+	}
+
+	err = n.conn.SetAddElements(set, addressElements(set, addresses))
+	if err != nil {
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+// DeleteAddresses removes addresses from one of the sets of exit addresses, in one transaction
+func (n *NFTables) DeleteAddresses(name string, addresses []net.IP) error {
+	set, err := n.lookupSet(name)
+	if err != nil {
+		return err
+	}
+
+	err = n.conn.SetDeleteElements(set, addressElements(set, addresses))
+	if err != nil {
+		return err
+	}
+
+	return n.conn.Flush()
+}
+
+func (n *NFTables) lookupSet(name string) (*nftables.Set, error) {
+	for _, set := range n.sets {
+		if set.Name == name {
+			return set, nil
+		}
+	}
+
+	return nil, fmt.Errorf("an nftables set named %s does not exist in table %s", name, n.table.Name)
+}
+
+// The elements of a set of exit addresses, with the addresses in the length of the set's type
+func addressElements(set *nftables.Set, addresses []net.IP) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, address := range addresses {
+		key := address.To16()
+		if set.KeyType == nftables.TypeIPAddr {
+			key = address.To4()
+		}
+
+		elements = append(elements, nftables.SetElement{Key: key})
+	}
+
+	return elements
+}
+
+// Return the current elements of the portforwarding maps, which are empty if the table doesn't exist yet
+func (n *NFTables) currentElements() (map[iptables.Protocol]map[uint16]string, error) {
+	current := make(map[iptables.Protocol]map[uint16]string)
+	for protocol, portMap := range n.maps {
+		if n.missing {
+			current[protocol] = make(map[uint16]string)
+			continue
+		}
+
+		elements, err := n.conn.GetSetElements(portMap)
+		if err != nil {
+			return nil, err
+		}
+
+		current[protocol] = make(map[uint16]string)
+		for _, element := range elements {
+			if len(element.Key) != 2 {
+				continue
+			}
+
+			current[protocol][binary.BigEndian.Uint16(element.Key)] = net.IP(element.Val).String()
+		}
+	}
+
+	return current, nil
+}
+
+func nftablesMapName(protocol iptables.Protocol) string {
+	if protocol == iptables.ProtocolIPv6 {
+		return nftablesMapIPv6
+	}
+
+	return nftablesMapIPv4
+}
+
+// Format a map element like nft does, e.g. 1234 : 10.99.0.1
+func formatElement(port uint16, address string) string {
+	return fmt.Sprintf("%d : %s", port, address)
+}
+
+func parseElement(element string) (nftables.SetElement, error) {
+	var port, address string
+	_, err := fmt.Sscanf(element, "%s : %s", &port, &address)
+	if err != nil {
+		return nftables.SetElement{}, fmt.Errorf("invalid map element %s", element)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nftables.SetElement{}, fmt.Errorf("invalid map element %s", element)
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nftables.SetElement{}, fmt.Errorf("invalid map element %s", element)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	key := make([]byte, 2)
+	binary.BigEndian.PutUint16(key, uint16(p))
+
+	return nftables.SetElement{Key: key, Val: ip}, nil
+}
@@ -0,0 +1,569 @@
+package portforward_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+	"golang.org/x/sys/unix"
+)
+
+// Tests for the nftables backend using a fake netlink connection, these run in short mode
+
+const nftablesTable = "wg-manager"
+
+var elementsFixture = []string{
+	"portforwarding_ipv4 1234 : 10.99.0.1",
+	"portforwarding_ipv4 4321 : 10.99.0.1",
+	"portforwarding_ipv6 1234 : fc00:bbbb:bbbb:bb01::1",
+	"portforwarding_ipv6 4321 : fc00:bbbb:bbbb:bb01::1",
+}
+
+var elementsUpdatedFixture = []string{
+	"portforwarding_ipv4 1234 : 10.99.0.1",
+	"portforwarding_ipv4 1337 : 10.99.0.1",
+	"portforwarding_ipv4 4322 : 10.99.0.1",
+	"portforwarding_ipv6 1234 : fc00:bbbb:bbbb:bb01::1",
+	"portforwarding_ipv6 1337 : fc00:bbbb:bbbb:bb01::1",
+	"portforwarding_ipv6 4322 : fc00:bbbb:bbbb:bb01::1",
+}
+
+// fakeNetlink answers the nftables netlink messages used for portforwarding, keeping the tables and the elements of each set in memory
+type fakeNetlink struct {
+	mu       sync.Mutex
+	tables   map[string]bool
+	elements map[string]map[string][]byte
+	messages map[uint16]int
+}
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{
+		tables:   make(map[string]bool),
+		elements: make(map[string]map[string][]byte),
+		messages: make(map[uint16]int),
+	}
+}
+
+func (f *fakeNetlink) dial(req []netlink.Message) ([]netlink.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var replies []netlink.Message
+	for _, msg := range req {
+		if msg.Header.Type>>8 != unix.NFNL_SUBSYS_NFTABLES {
+			// Start and end of a batch
+			continue
+		}
+
+		msgType := uint16(msg.Header.Type & 0xff)
+		f.messages[msgType]++
+
+		switch msgType {
+		case unix.NFT_MSG_NEWTABLE:
+			name, err := decodeTableName(msg.Data[4:])
+			if err != nil {
+				return nil, err
+			}
+
+			f.tables[name] = true
+			continue
+		case unix.NFT_MSG_GETTABLE:
+			for name := range f.tables {
+				reply, err := encodeTable(name)
+				if err != nil {
+					return nil, err
+				}
+
+				reply.Header.Sequence = msg.Header.Sequence
+				replies = append(replies, reply)
+			}
+			continue
+		case unix.NFT_MSG_NEWSETELEM, unix.NFT_MSG_DELSETELEM, unix.NFT_MSG_GETSETELEM:
+		default:
+			continue
+		}
+
+		name, elements, err := decodeElements(msg.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+
+		switch msgType {
+		case unix.NFT_MSG_NEWSETELEM:
+			if f.elements[name] == nil {
+				f.elements[name] = make(map[string][]byte)
+			}
+
+			for key, element := range elements {
+				if _, ok := f.elements[name][key]; ok {
+					return nil, fmt.Errorf("element %x already exists in %s", key, name)
+				}
+
+				f.elements[name][key] = element
+			}
+		case unix.NFT_MSG_DELSETELEM:
+			if elements == nil {
+				delete(f.elements, name)
+			}
+
+			for key := range elements {
+				if _, ok := f.elements[name][key]; !ok {
+					return nil, fmt.Errorf("element %x does not exist in %s", key, name)
+				}
+
+				delete(f.elements[name], key)
+			}
+		case unix.NFT_MSG_GETSETELEM:
+			reply, err := encodeElements(name, f.elements[name])
+			if err != nil {
+				return nil, err
+			}
+
+			replies = append(replies, reply...)
+		}
+	}
+
+	return replies, nil
+}
+
+// Return the elements of the sets as strings, like "portforwarding_ipv4 1234 : 10.99.0.1" for maps and "PORTFORWARDING_IPV4 185.65.134.1" for sets
+func (f *fakeNetlink) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := []string{}
+	for name, elements := range f.elements {
+		for _, element := range elements {
+			ad, err := netlink.NewAttributeDecoder(element)
+			if err != nil {
+				panic(err)
+			}
+
+			var key, value []byte
+			for ad.Next() {
+				switch ad.Type() {
+				case unix.NFTA_SET_ELEM_KEY:
+					key = decodeDataValue(ad.Bytes())
+				case unix.NFTA_SET_ELEM_DATA:
+					value = decodeDataValue(ad.Bytes())
+				}
+			}
+
+			if value == nil {
+				list = append(list, fmt.Sprintf("%s %s", name, net.IP(key)))
+				continue
+			}
+
+			list = append(list, fmt.Sprintf("%s %d : %s", name, binary.BigEndian.Uint16(key), net.IP(value)))
+		}
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// Decode the name of a table from a table message
+func decodeTableName(data []byte) (string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return "", err
+	}
+
+	var name string
+	for ad.Next() {
+		if ad.Type() == unix.NFTA_TABLE_NAME {
+			name = ad.String()
+		}
+	}
+
+	return name, ad.Err()
+}
+
+// Encode a table as the reply to a request for the tables
+func encodeTable(name string) (netlink.Message, error) {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_TABLE_NAME, Data: []byte(name + "\x00")},
+	})
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWTABLE)},
+		Data:   append([]byte{unix.NFPROTO_INET, 0, 0, 0}, data...),
+	}, nil
+}
+
+// Decode the name of the set and the elements of a set element message, with the elements keyed by their key
+func decodeElements(data []byte) (string, map[string][]byte, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var name string
+	var elements map[string][]byte
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_SET_ELEM_LIST_SET:
+			name = ad.String()
+		case unix.NFTA_SET_ELEM_LIST_ELEMENTS:
+			elements = make(map[string][]byte)
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					element := nad.Bytes()
+					ead, err := netlink.NewAttributeDecoder(element)
+					if err != nil {
+						return err
+					}
+
+					for ead.Next() {
+						if ead.Type() == unix.NFTA_SET_ELEM_KEY {
+							elements[string(decodeDataValue(ead.Bytes()))] = element
+						}
+					}
+				}
+
+				return nil
+			})
+		}
+	}
+
+	return name, elements, ad.Err()
+}
+
+func decodeDataValue(data []byte) []byte {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		panic(err)
+	}
+
+	for ad.Next() {
+		if ad.Type() == unix.NFTA_DATA_VALUE {
+			return ad.Bytes()
+		}
+	}
+
+	return nil
+}
+
+// Encode the elements of a set as the reply to a request for them
+func encodeElements(name string, elements map[string][]byte) ([]netlink.Message, error) {
+	if len(elements) == 0 {
+		return nil, nil
+	}
+
+	var list []netlink.Attribute
+	for _, element := range elements {
+		list = append(list, netlink.Attribute{Type: unix.NFTA_LIST_ELEM | unix.NLA_F_NESTED, Data: element})
+	}
+
+	encodedList, err := netlink.MarshalAttributes(list)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(nftablesTable + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(name + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_ELEMENTS | unix.NLA_F_NESTED, Data: encodedList},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWSETELEM)},
+		Data:   append([]byte{unix.NFPROTO_INET, 0, 0, 0}, data...),
+	}}, nil
+}
+
+func newNFTables(t *testing.T) (*portforward.NFTables, *fakeNetlink) {
+	t.Helper()
+
+	fake := newFakeNetlink()
+	conn := newFakeConn(t, fake)
+
+	n, err := portforward.NewNFTablesWithConn(conn, nftablesTable, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n, fake
+}
+
+func newFakeConn(t *testing.T, fake *fakeNetlink) *nftables.Conn {
+	t.Helper()
+
+	conn, err := nftables.New(nftables.WithTestDial(fake.dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestNFTablesSetup(t *testing.T) {
+	_, fake := newNFTables(t)
+
+	want := map[uint16]int{
+		unix.NFT_MSG_NEWTABLE: 1,
+		unix.NFT_MSG_NEWCHAIN: 1,
+		// The chain is flushed by deleting its rules
+		unix.NFT_MSG_DELRULE: 1,
+		// A set of exit addresses and a map of ports per address family
+		unix.NFT_MSG_NEWSET: 4,
+		// A rule per address family and transport protocol
+		unix.NFT_MSG_NEWRULE: 4,
+	}
+
+	if diff := cmp.Diff(want, fake.messages); diff != "" {
+		t.Fatalf("unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestNFTables(t *testing.T) {
+	n, fake := newNFTables(t)
+
+	t.Run("add elements", func(t *testing.T) {
+		n.UpdatePortforwarding(apiFixture)
+
+		if diff := cmp.Diff(elementsFixture, fake.list()); diff != "" {
+			t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("no changes", func(t *testing.T) {
+		changes, err := n.PlanPortforwarding(apiFixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(changes) != 0 {
+			t.Fatalf("expected no changes, got %+v", changes)
+		}
+	})
+
+	t.Run("remove elements", func(t *testing.T) {
+		n.UpdatePortforwarding(api.WireguardPeerList{})
+
+		if diff := cmp.Diff([]string{}, fake.list()); diff != "" {
+			t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("add and remove elements for single peer", func(t *testing.T) {
+		n.AddPortforwarding(apiFixture[0])
+
+		if diff := cmp.Diff(elementsFixture, fake.list()); diff != "" {
+			t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+		}
+
+		n.RemovePortforwarding(apiFixture[0])
+
+		if diff := cmp.Diff([]string{}, fake.list()); diff != "" {
+			t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("update elements for single peer", func(t *testing.T) {
+		n.AddPortforwarding(apiFixture[0])
+
+		updatedFixture := apiFixture[0]
+		updatedFixture.Ports = rulesUpdatedPortsFixture
+
+		n.UpdateSinglePeerPortforwarding(updatedFixture)
+
+		if diff := cmp.Diff(elementsUpdatedFixture, fake.list()); diff != "" {
+			t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("port moved to another peer", func(t *testing.T) {
+		other := apiFixture[0]
+		other.IPv4 = "10.99.0.2/32"
+		other.IPv6 = "fc00:bbbb:bbbb:bb01::2/128"
+		other.Ports = []int{1234}
+
+		n.AddPortforwarding(other)
+
+		// Removing the previous peer leaves the port of the other peer alone
+		updatedFixture := apiFixture[0]
+		updatedFixture.Ports = rulesUpdatedPortsFixture
+		n.RemovePortforwarding(updatedFixture)
+
+		want := []string{
+			"portforwarding_ipv4 1234 : 10.99.0.2",
+			"portforwarding_ipv6 1234 : fc00:bbbb:bbbb:bb01::2",
+		}
+
+		if diff := cmp.Diff(want, fake.list()); diff != "" {
+			t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestNFTablesWithCities(t *testing.T) {
+	n, fake := newNFTables(t)
+
+	n.UpdatePortforwarding(apiFixtureCities)
+	if diff := cmp.Diff(elementsFixture, fake.list()); diff != "" {
+		t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+	}
+
+	n.UpdatePortforwarding(apiFixtureBrokenCities)
+	if diff := cmp.Diff([]string{}, fake.list()); diff != "" {
+		t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+	}
+}
+
+func TestNFTablesApplyBatch(t *testing.T) {
+	n, fake := newNFTables(t)
+
+	updatedFixture := apiFixture[0]
+	updatedFixture.Ports = rulesUpdatedPortsFixture
+
+	batch := portforward.NewBatch()
+	batch.Add(apiFixture[0])
+	batch.Update(updatedFixture)
+
+	before := fake.messages[unix.NFT_MSG_NEWSETELEM]
+
+	err := n.ApplyBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(elementsUpdatedFixture, fake.list()); diff != "" {
+		t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+	}
+
+	// Only the final elements are added, with one message per map
+	if added := fake.messages[unix.NFT_MSG_NEWSETELEM] - before; added != 2 {
+		t.Fatalf("expected one message per map, got %d", added)
+	}
+}
+
+func TestNFTablesPlanPortforwarding(t *testing.T) {
+	n, fake := newNFTables(t)
+	n.AddPortforwarding(apiFixture[0])
+
+	updatedFixture := apiFixture[0]
+	updatedFixture.Ports = []int{1234}
+
+	changes, err := n.PlanPortforwarding(api.WireguardPeerList{updatedFixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []portforward.RuleChange{
+		{Protocol: "ipv4", Table: nftablesTable, Chain: "portforwarding_ipv4", Action: portforward.ActionDelete, Rule: "4321 : 10.99.0.1"},
+		{Protocol: "ipv6", Table: nftablesTable, Chain: "portforwarding_ipv6", Action: portforward.ActionDelete, Rule: "4321 : fc00:bbbb:bbbb:bb01::1"},
+	}
+
+	if diff := cmp.Diff(want, changes, cmp.AllowUnexported(portforward.RuleChange{}), cmp.FilterPath(func(p cmp.Path) bool {
+		return p.Last().String() == ".protocol"
+	}, cmp.Ignore())); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(elementsFixture, fake.list()); diff != "" {
+		t.Fatalf("plan changed the elements (-want +got):\n%s", diff)
+	}
+}
+
+func TestNFTablesPlanWithoutTable(t *testing.T) {
+	fake := newFakeNetlink()
+
+	n, err := portforward.NewNFTablesForPlanWithConn(newFakeConn(t, fake), nftablesTable, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := n.PlanPortforwarding(apiFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, change := range changes {
+		if change.Action != portforward.ActionInsert {
+			t.Fatalf("expected only inserts, got %+v", change)
+		}
+
+		got = append(got, change.Chain+" "+change.Rule)
+	}
+
+	if diff := cmp.Diff(elementsFixture, got); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	// Only the tables were listed, nothing was created
+	if diff := cmp.Diff(map[uint16]int{unix.NFT_MSG_GETTABLE: 1}, fake.messages); diff != "" {
+		t.Fatalf("unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestNFTablesPlanExistingTable(t *testing.T) {
+	n, fake := newNFTables(t)
+	n.UpdatePortforwarding(apiFixture)
+
+	planning, err := portforward.NewNFTablesForPlanWithConn(newFakeConn(t, fake), nftablesTable, ipsetIPv4, ipsetIPv6, "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := fake.messages[unix.NFT_MSG_NEWTABLE]
+
+	changes, err := planning.PlanPortforwarding(apiFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 0 {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+
+	if fake.messages[unix.NFT_MSG_NEWTABLE] != before || fake.messages[unix.NFT_MSG_DELRULE] != 1 {
+		t.Fatalf("planning changed the table: %+v", fake.messages)
+	}
+}
+
+func TestNFTablesExitAddresses(t *testing.T) {
+	n, fake := newNFTables(t)
+
+	e := portforward.NewExitAddresses(n, ipsetIPv4, ipsetIPv6, []net.IP{net.ParseIP("185.65.134.1"), net.ParseIP("2a03:1b20:1:f011::1")}, nil)
+	if err := e.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"PORTFORWARDING_IPV4 185.65.134.1",
+		"PORTFORWARDING_IPV6 2a03:1b20:1:f011::1",
+	}
+	if diff := cmp.Diff(want, fake.list()); diff != "" {
+		t.Fatalf("unexpected elements (-want +got):\n%s", diff)
+	}
+
+	addresses, err := n.ListAddresses(ipsetIPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addresses) != 1 || !addresses[0].Equal(net.ParseIP("185.65.134.1")) {
+		t.Fatalf("unexpected addresses %v", addresses)
+	}
+
+	if _, err := n.ListAddresses("MISSING"); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -1,6 +1,7 @@
 package portforward
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -10,50 +11,130 @@ import (
 	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
-	"github.com/digineo/go-ipset/v2"
-	"github.com/mdlayher/netlink"
 	"github.com/mullvad/wg-manager/api"
-	"github.com/ti-mo/netfilter"
 )
 
-// Portforward is a utility for managing portforwarding
+// Backend manages the portforwarding rules for peers
+// It is implemented by Portforward for iptables, and by NFTables for nftables
+type Backend interface {
+	NewRuleSet() RuleSet
+	UpdateRuleSet(set RuleSet) error
+	UpdatePortforwarding(peers api.WireguardPeerList)
+	PlanPortforwarding(peers api.WireguardPeerList) ([]RuleChange, error)
+	AddPortforwarding(peer api.WireguardPeer)
+	RemovePortforwarding(peer api.WireguardPeer)
+	UpdateSinglePeerPortforwarding(peer api.WireguardPeer)
+	ApplyBatch(b *Batch) error
+}
+
+// RuleSet is a set of portforwarding rules, which can be built up one peer at a time while the peers are being decoded
+// A RuleSet can only be used with the Backend that created it
+type RuleSet interface {
+	Add(peer api.WireguardPeer)
+}
+
+// Portforward is a utility for managing portforwarding with iptables
 type Portforward struct {
-	iptables  *iptables.IPTables
-	ip6tables *iptables.IPTables
-	chains    []Chain
-	ipsetIPv4 string
-	ipsetIPv6 string
-	location  string
+	iptables    IPTables
+	ip6tables   IPTables
+	chains      []Chain
+	chainPrefix string
+	ipsetIPv4   string
+	ipsetIPv6   string
+	location    string
+
+	// Set when bootstrapping, to create and repair the chains, jump rules and ipsets
+	ipsets IPSets
+
+	// Set when planning, so that nothing is created or repaired, and missing chains are treated as empty
+	planning bool
+
+	// The chains that were left with peer rules in them, per protocol, to notice them being flushed when bootstrapping
+	populated map[chainKey]bool
 }
 
-// Chain contains a chain name and a transport protocol
+// A chain of one protocol
+type chainKey struct {
+	protocol iptables.Protocol
+	chain    string
+}
+
+// Chain contains a chain name, the table it's in and a transport protocol
+// The forward filter chain has rules for every transport protocol, and no transport protocol of its own
 type Chain struct {
 	name              string
+	table             string
 	transportProtocol string
 }
 
-// Iptables table to operate against
-const table = "nat"
+// Iptables tables to operate against
+const (
+	natTable    = "nat"
+	filterTable = "filter"
+)
+
+// The table of a RuleChange creating an ipset
+const ipsetTable = "ipset"
+
+// The last rule of the forward filter chain, dropping DNATed traffic that no peer rule accepted
+const forwardDropRule = "-j DROP"
 
 // Transport protocols that we want to create chains for
 var transportProtocols = []string{"tcp", "udp"}
 
-// New validates the addresses, ensures that the iptables portforwarding chains exists, and returns a new Portforward instance
-func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+// IPTables is the set of iptables operations used for portforwarding
+// It is implemented by SystemIPTables, and by MemoryIPTables for testing without a kernel
+type IPTables interface {
+	ListChains(table string) ([]string, error)
+	List(table, chain string) ([]string, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	Restore(table string, commands []string) error
+}
+
+// ChainNames returns the names of the iptables chains used for portforwarding with the given prefix
+func ChainNames(chainPrefix string) []string {
+	var names []string
+	for _, chain := range newChains(chainPrefix) {
+		names = append(names, chain.name)
+	}
+
+	return names
+}
+
+func newChains(chainPrefix string) []Chain {
 	var chains []Chain
 	for _, transportProtocol := range transportProtocols {
 		chains = append(chains, Chain{
 			name:              chainPrefix + "_" + strings.ToUpper(transportProtocol),
+			table:             natTable,
 			transportProtocol: transportProtocol,
 		})
 	}
 
-	ipt, err := newIPTables(chains, iptables.ProtocolIPv4)
+	return chains
+}
+
+// ForwardChainName returns the name of the iptables filter chain used for portforwarding with the given prefix
+func ForwardChainName(chainPrefix string) string {
+	return chainPrefix + "_FORWARD"
+}
+
+func newForwardChain(chainPrefix string) Chain {
+	return Chain{
+		name:  ForwardChainName(chainPrefix),
+		table: filterTable,
+	}
+}
+
+// New validates the addresses, ensures that the iptables portforwarding chains and ipsets exists, and returns a new Portforward instance
+func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+	ipt, err := NewSystemIPTables(iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, err
 	}
 
-	ip6t, err := newIPTables(chains, iptables.ProtocolIPv6)
+	ip6t, err := NewSystemIPTables(iptables.ProtocolIPv6)
 	if err != nil {
 		return nil, err
 	}
@@ -68,39 +149,431 @@ func New(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, locat
 		return nil, err
 	}
 
+	return NewWithIPTables(ipt, ip6t, chainPrefix, ipsetTableIPv4, ipsetTableIPv6, location)
+}
+
+// NewWithIPTables validates the addresses, ensures that the portforwarding chains exists in the given iptables, and returns a new Portforward instance
+// The existence of the ipsets is not checked
+func NewWithIPTables(ipt IPTables, ip6t IPTables, chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+	chains := newChains(chainPrefix)
+
+	err := validateChains(ipt, chains)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateChains(ip6t, chains)
+	if err != nil {
+		return nil, err
+	}
+
 	err = validateLocation(location)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Portforward{
-		iptables:  ipt,
-		ip6tables: ip6t,
-		chains:    chains,
-		ipsetIPv4: ipsetTableIPv4,
-		ipsetIPv6: ipsetTableIPv6,
-		location:  location,
+		iptables:    ipt,
+		ip6tables:   ip6t,
+		chains:      chains,
+		chainPrefix: chainPrefix,
+		ipsetIPv4:   ipsetTableIPv4,
+		ipsetIPv6:   ipsetTableIPv6,
+		location:    location,
 	}, nil
 }
 
-func newIPTables(chains []Chain, protocol iptables.Protocol) (*iptables.IPTables, error) {
-	ipt, err := iptables.NewWithProtocol(protocol)
+// EnableForwardFilter makes the Portforward manage a chain in the filter table along with the nat chains,
+// which accepts the DNATed traffic to the forwarded ports of each peer and drops all other DNATed traffic
+// The chain is created when bootstrapping, otherwise it has to exist already
+func (p *Portforward) EnableForwardFilter() error {
+	chain := newForwardChain(p.chainPrefix)
+	for _, c := range p.chains {
+		if c.name == chain.name {
+			return nil
+		}
+	}
+
+	if p.ipsets == nil {
+		for _, ipt := range []IPTables{p.iptables, p.ip6tables} {
+			err := validateChains(ipt, []Chain{chain})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	p.chains = append(p.chains, chain)
+
+	if p.ipsets != nil && !p.planning {
+		_, err := p.Bootstrap()
+		return err
+	}
+
+	return nil
+}
+
+// NewBootstrapped creates the iptables portforwarding chains, the jump rules to them from PREROUTING and the ipsets if they don't exist,
+// and returns a new Portforward instance which can repair them with Bootstrap
+func NewBootstrapped(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+	ipt, err := NewSystemIPTables(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	ip6t, err := NewSystemIPTables(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBootstrappedWithIPTables(ipt, ip6t, NewSystemIPSets(), chainPrefix, ipsetTableIPv4, ipsetTableIPv6, location)
+}
+
+// NewBootstrappedWithIPTables is NewBootstrapped using the given iptables and ipsets
+func NewBootstrappedWithIPTables(ipt IPTables, ip6t IPTables, ipsets IPSets, chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+	// Validate the location before touching anything
+	err := validateLocation(location)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newBootstrapped(ipt, ip6t, ipsets, chainPrefix, ipsetTableIPv4, ipsetTableIPv6, location)
+
+	_, err = p.Bootstrap()
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// NewBootstrappedForPlan returns a new Portforward instance like NewBootstrapped, but without creating or repairing anything
+// PlanBootstrap returns what would be created instead, and PlanPortforwarding treats the missing chains as empty
+func NewBootstrappedForPlan(chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+	ipt, err := NewSystemIPTables(iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, err
 	}
 
-	currentChains, err := ipt.ListChains("nat")
+	ip6t, err := NewSystemIPTables(iptables.ProtocolIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBootstrappedForPlanWithIPTables(ipt, ip6t, NewSystemIPSets(), chainPrefix, ipsetTableIPv4, ipsetTableIPv6, location)
+}
+
+// NewBootstrappedForPlanWithIPTables is NewBootstrappedForPlan using the given iptables and ipsets
+func NewBootstrappedForPlanWithIPTables(ipt IPTables, ip6t IPTables, ipsets IPSets, chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) (*Portforward, error) {
+	err := validateLocation(location)
 	if err != nil {
 		return nil, err
 	}
 
+	p := newBootstrapped(ipt, ip6t, ipsets, chainPrefix, ipsetTableIPv4, ipsetTableIPv6, location)
+	p.planning = true
+
+	return p, nil
+}
+
+func newBootstrapped(ipt IPTables, ip6t IPTables, ipsets IPSets, chainPrefix string, ipsetTableIPv4 string, ipsetTableIPv6 string, location string) *Portforward {
+	return &Portforward{
+		iptables:    ipt,
+		ip6tables:   ip6t,
+		chains:      newChains(chainPrefix),
+		chainPrefix: chainPrefix,
+		ipsetIPv4:   ipsetTableIPv4,
+		ipsetIPv6:   ipsetTableIPv6,
+		location:    location,
+		ipsets:      ipsets,
+	}
+}
+
+// Bootstrap creates the portforwarding chains, the jump rules to them from PREROUTING, or FORWARD for the forward filter chain, and the ipsets, if they don't exist,
+// and returns whether anything had to be repaired, which includes chains that were flushed after being filled with peer rules
+// The jump rule to the forward filter chain is kept first in FORWARD, and moved back there if other rules were inserted before it
+// Rules that were removed along with a chain or jump rule, or by flushing a chain, aren't restored, that's up to the next UpdateRuleSet
+// An existing ipset for the wrong protocol is an error, as it can't be replaced while it's in use
+func (p *Portforward) Bootstrap() (bool, error) {
+	if p.ipsets == nil {
+		return false, fmt.Errorf("portforwarding bootstrapping isn't enabled")
+	}
+
+	if p.planning {
+		return false, fmt.Errorf("portforwarding bootstrapping is disabled for planning")
+	}
+
+	created := false
+	for protocol, ipt := range map[iptables.Protocol]IPTables{iptables.ProtocolIPv4: p.iptables, iptables.ProtocolIPv6: p.ip6tables} {
+		chainsCreated, err := p.bootstrapChains(protocol, ipt)
+		if err != nil {
+			return created, err
+		}
+
+		created = created || chainsCreated
+	}
+
+	ipsetsCreated, err := p.bootstrapIPSets()
+	return created || ipsetsCreated, err
+}
+
+// The built-in chain that sends traffic to a portforwarding chain, and the rule in it that does so
+// Only the original direction of DNATed connections is filtered, the replies are left alone
+func jumpRule(chain Chain) (string, string) {
+	if chain.table == filterTable {
+		return "FORWARD", fmt.Sprintf("-m conntrack --ctstate DNAT --ctdir ORIGINAL -j %s", chain.name)
+	}
+
+	return "PREROUTING", fmt.Sprintf("-p %s -j %s", chain.transportProtocol, chain.name)
+}
+
+// PlanBootstrap returns the chains, rules and ipsets Bootstrap would create, without creating them
+// Created chains and ipsets have the action ActionCreate, and ipsets are in the table "ipset"
+func (p *Portforward) PlanBootstrap() ([]RuleChange, error) {
+	if p.ipsets == nil {
+		return nil, fmt.Errorf("portforwarding bootstrapping isn't enabled")
+	}
+
+	var changes []RuleChange
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		commands, _, err := p.bootstrapCommands(protocol, p.protocolIPTables(protocol))
+		if err != nil {
+			return nil, fmt.Errorf("error getting current iptables chains %s", err.Error())
+		}
+
+		for _, table := range p.tables() {
+			for _, command := range commands[table] {
+				changes = append(changes, commandChange(protocol, table, command))
+			}
+		}
+	}
+
+	missing, err := p.missingIPSets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, protocol := range missing {
+		changes = append(changes, newRuleChange(protocol, ipsetTable, p.ipsetName(protocol), ActionCreate, ""))
+	}
+
+	return changes, nil
+}
+
+// Describe an iptables-restore command creating a chain, or adding or deleting a rule, as a RuleChange
+func commandChange(protocol iptables.Protocol, table string, command string) RuleChange {
+	fields := strings.SplitN(command, " ", 3)
+	if fields[0] == "-N" || len(fields) < 3 {
+		return newRuleChange(protocol, table, fields[1], ActionCreate, "")
+	}
+
+	switch fields[0] {
+	case "-D":
+		return newRuleChange(protocol, table, fields[1], ActionDelete, fields[2])
+	case "-I":
+		// Leave out the position
+		return newRuleChange(protocol, table, fields[1], ActionInsert, strings.SplitN(fields[2], " ", 2)[1])
+	default:
+		return newRuleChange(protocol, table, fields[1], ActionInsert, fields[2])
+	}
+}
+
+func (p *Portforward) bootstrapChains(protocol iptables.Protocol, ipt IPTables) (bool, error) {
+	commands, repaired, err := p.bootstrapCommands(protocol, ipt)
+	if err != nil {
+		return false, err
+	}
+
+	for _, table := range p.tables() {
+		if len(commands[table]) == 0 {
+			continue
+		}
+
+		for _, command := range commands[table] {
+			log.Printf("repairing %s iptables %s table: %s", protocolName(protocol), table, command)
+		}
+
+		repaired = true
+		err := ipt.Restore(table, commands[table])
+		if err != nil {
+			return repaired, err
+		}
+	}
+
+	return repaired, nil
+}
+
+// Return the iptables-restore commands per table creating the missing chains and rules, and whether a chain with peer rules in it was flushed
+func (p *Portforward) bootstrapCommands(protocol iptables.Protocol, ipt IPTables) (map[string][]string, bool, error) {
+	flushed := false
+	commands := make(map[string][]string)
+	currentChains := make(map[string][]string)
+	builtinRules := make(map[string][]string)
+
+	for _, chain := range p.chains {
+		if _, ok := currentChains[chain.table]; !ok {
+			chains, err := ipt.ListChains(chain.table)
+			if err != nil {
+				return nil, false, err
+			}
+
+			currentChains[chain.table] = chains
+		}
+
+		if !chainExists(chain.name, currentChains[chain.table]) {
+			commands[chain.table] = append(commands[chain.table], fmt.Sprintf("-N %s", chain.name))
+
+			if chain.table == filterTable {
+				commands[chain.table] = append(commands[chain.table], fmt.Sprintf("-A %s %s", chain.name, forwardDropRule))
+			}
+		} else if p.populated[chainKey{protocol, chain.name}] || chain.table == filterTable {
+			rules, err := ipt.List(chain.table, chain.name)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if p.populated[chainKey{protocol, chain.name}] && len(p.filterRules(chain, rules)) == 0 {
+				log.Printf("%s iptables chain %s was flushed", protocolName(protocol), chain.name)
+				flushed = true
+			}
+
+			drop := fmt.Sprintf("-A %s %s", chain.name, forwardDropRule)
+			if chain.table == filterTable && !ruleExists(drop, rules) {
+				commands[chain.table] = append(commands[chain.table], drop)
+			}
+		}
+
+		builtin, jump := jumpRule(chain)
+		if _, ok := builtinRules[builtin]; !ok {
+			rules, err := ipt.List(chain.table, builtin)
+			if err != nil {
+				return nil, false, err
+			}
+
+			builtinRules[builtin] = rules
+		}
+
+		rule := fmt.Sprintf("-A %s %s", builtin, jump)
+		if chain.table != filterTable {
+			if !ruleExists(rule, builtinRules[builtin]) {
+				commands[chain.table] = append(commands[chain.table], rule)
+			}
+		} else if !firstRule(rule, builtinRules[builtin]) {
+			// An ACCEPT rule in FORWARD before the jump, e.g. for established connections, would let DNATed traffic skip the forward filter chain
+			if ruleExists(rule, builtinRules[builtin]) {
+				commands[chain.table] = append(commands[chain.table], fmt.Sprintf("-D %s %s", builtin, jump))
+			}
+
+			commands[chain.table] = append(commands[chain.table], fmt.Sprintf("-I %s 1 %s", builtin, jump))
+		}
+	}
+
+	return commands, flushed, nil
+}
+
+// Whether the rule is the first rule of the listed chain
+// The first line of a listed chain is its policy, or its creation, rather than a rule
+func firstRule(rule string, rules []string) bool {
+	return len(rules) > 1 && rules[1] == rule
+}
+
+// The tables of the portforwarding chains, in the order they're first used
+func (p *Portforward) tables() []string {
+	var tables []string
+	for _, chain := range p.chains {
+		if len(tables) == 0 || tables[len(tables)-1] != chain.table {
+			tables = append(tables, chain.table)
+		}
+	}
+
+	return tables
+}
+
+func ruleExists(rule string, rules []string) bool {
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Portforward) bootstrapIPSets() (bool, error) {
+	missing, err := p.missingIPSets()
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	for _, protocol := range missing {
+		name := p.ipsetName(protocol)
+
+		log.Printf("creating %s ipset %s", protocolName(protocol), name)
+		err := p.ipsets.CreateSet(name, protocol)
+		if err != nil {
+			return created, fmt.Errorf("error creating ipset %s %s", name, err.Error())
+		}
+
+		created = true
+	}
+
+	return created, nil
+}
+
+// Return the protocols whose ipset doesn't exist
+// An existing ipset for the wrong protocol is an error
+func (p *Portforward) missingIPSets() ([]iptables.Protocol, error) {
+	sets, err := p.ipsets.ListSets()
+	if err != nil {
+		return nil, fmt.Errorf("error listing ipsets %s", err.Error())
+	}
+
+	var missing []iptables.Protocol
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		name := p.ipsetName(protocol)
+
+		current, ok := sets[name]
+		if ok && current != protocol {
+			return nil, fmt.Errorf("the ipset %s is for %s addresses, not %s", name, protocolName(current), protocolName(protocol))
+		}
+		if !ok {
+			missing = append(missing, protocol)
+		}
+	}
+
+	return missing, nil
+}
+
+func (p *Portforward) ipsetName(protocol iptables.Protocol) string {
+	if protocol == iptables.ProtocolIPv6 {
+		return p.ipsetIPv6
+	}
+
+	return p.ipsetIPv4
+}
+
+func (p *Portforward) protocolIPTables(protocol iptables.Protocol) IPTables {
+	if protocol == iptables.ProtocolIPv6 {
+		return p.ip6tables
+	}
+
+	return p.iptables
+}
+
+func validateChains(ipt IPTables, chains []Chain) error {
 	for _, chain := range chains {
+		currentChains, err := ipt.ListChains(chain.table)
+		if err != nil {
+			return err
+		}
+
 		if !chainExists(chain.name, currentChains) {
-			return nil, fmt.Errorf("an iptables chain named %s does not exist", chain)
+			return fmt.Errorf("an iptables chain named %s does not exist", chain.name)
 		}
 	}
 
-	return ipt, nil
+	return nil
 }
 
 func validateLocation(location string) error {
@@ -123,70 +596,382 @@ func chainExists(chain string, currentChains []string) bool {
 }
 
 func validateIPSet(name string) error {
-	conn, err := ipset.Dial(netfilter.ProtoUnspec, &netlink.Config{})
+	ipsets, err := NewSystemIPSets().ListSets()
 	if err != nil {
 		return err
 	}
 
-	ipsets, err := conn.ListAll()
-
-	for _, p := range ipsets {
-		if p.Name.Get() == name {
-			return nil
-		}
+	if _, ok := ipsets[name]; ok {
+		return nil
 	}
 
 	return fmt.Errorf("an ipset named %s does not exist", name)
 }
 
+// RuleChange is a change to an iptables rule for portforwarding, or to an element of a portforwarding map for nftables
+// When bootstrapping it can also be the creation of an iptables chain or an ipset, without a rule
+type RuleChange struct {
+	Protocol string `json:"protocol"`
+	Table    string `json:"table"`
+	Chain    string `json:"chain"`
+	Action   string `json:"action"`
+	Rule     string `json:"rule"`
+
+	protocol iptables.Protocol
+}
+
+// Actions of a RuleChange
+const (
+	ActionInsert = "insert"
+	ActionDelete = "delete"
+	ActionCreate = "create"
+)
+
+func newRuleChange(protocol iptables.Protocol, table string, chain string, action string, rule string) RuleChange {
+	return RuleChange{
+		Protocol: protocolName(protocol),
+		Table:    table,
+		Chain:    chain,
+		Action:   action,
+		Rule:     rule,
+		protocol: protocol,
+	}
+}
+
+func protocolName(protocol iptables.Protocol) string {
+	if protocol == iptables.ProtocolIPv6 {
+		return "ipv6"
+	}
+
+	return "ipv4"
+}
+
+// The iptables rules of each chain
+type iptablesRuleSet struct {
+	p     *Portforward
+	rules map[string]map[string]iptables.Protocol
+}
+
+// NewRuleSet returns a new empty RuleSet
+func (p *Portforward) NewRuleSet() RuleSet {
+	return p.newRuleSet()
+}
+
+func (p *Portforward) newRuleSet() *iptablesRuleSet {
+	rules := make(map[string]map[string]iptables.Protocol)
+	for _, chain := range p.chains {
+		rules[chain.name] = make(map[string]iptables.Protocol)
+	}
+
+	return &iptablesRuleSet{
+		p:     p,
+		rules: rules,
+	}
+}
+
+// Add adds the portforwarding rules for a peer to the set
+func (s *iptablesRuleSet) Add(peer api.WireguardPeer) {
+	if len(peer.Ports) < 1 {
+		return
+	}
+
+	for _, chain := range s.p.chains {
+		s.p.createPeerRules(peer, chain, s.rules[chain.name])
+	}
+}
+
+// Take the wireguard peers and convert them into a set of rules for easier comparison
+func (p *Portforward) mapRules(peers api.WireguardPeerList) *iptablesRuleSet {
+	set := p.newRuleSet()
+	for _, peer := range peers {
+		set.Add(peer)
+	}
+
+	return set
+}
+
 // UpdatePortforwarding updates the iptables rules for portforwarding to match the given list of peers
 func (p *Portforward) UpdatePortforwarding(peers api.WireguardPeerList) {
+	p.UpdateRuleSet(p.mapRules(peers))
+}
+
+// UpdateRuleSet updates the iptables rules for portforwarding to match the given set of rules
+// Every chain is flushed and filled with the given rules in one iptables-restore transaction per protocol and table,
+// so the chains are never seen half-updated and the current rules don't have to be listed first
+func (p *Portforward) UpdateRuleSet(ruleSet RuleSet) error {
+	set, ok := ruleSet.(*iptablesRuleSet)
+	if !ok {
+		log.Printf("error updating iptables rules, the rule set is for another backend")
+		return errors.New("the rule set is for another backend")
+	}
+
+	err := p.restoreTables(p.renderRuleSet(set))
+	if err != nil {
+		log.Printf("error updating iptables rules %s", err.Error())
+		return err
+	}
+
+	p.populated = make(map[chainKey]bool)
 	for _, chain := range p.chains {
-		rules := make(map[string]iptables.Protocol)
-		for _, peer := range peers {
-			if len(peer.Ports) < 1 {
+		for _, protocol := range set.rules[chain.name] {
+			p.populated[chainKey{protocol, chain.name}] = true
+		}
+	}
+
+	return nil
+}
+
+// A table of one protocol, which iptables-restore applies commands to in one transaction
+type restoreTable struct {
+	protocol iptables.Protocol
+	table    string
+}
+
+// Render the iptables-restore commands replacing the rules of every chain with the rules of the set, per protocol and table
+func (p *Portforward) renderRuleSet(set *iptablesRuleSet) map[restoreTable][]string {
+	commands := make(map[restoreTable][]string)
+	for _, chain := range p.chains {
+		for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+			key := restoreTable{protocol, chain.table}
+			commands[key] = append(commands[key], fmt.Sprintf("-F %s", chain.name))
+		}
+
+		// Sort the rules so that the chains end up in the same order every time
+		var rules []string
+		for rule := range set.rules[chain.name] {
+			rules = append(rules, rule)
+		}
+		sort.Strings(rules)
+
+		for _, rule := range rules {
+			key := restoreTable{set.rules[chain.name][rule], chain.table}
+			commands[key] = append(commands[key], fmt.Sprintf("-A %s %s", chain.name, rule))
+		}
+
+		if chain.table == filterTable {
+			for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+				key := restoreTable{protocol, chain.table}
+				commands[key] = append(commands[key], fmt.Sprintf("-A %s %s", chain.name, forwardDropRule))
+			}
+		}
+	}
+
+	return commands
+}
+
+// Apply the commands with one iptables-restore transaction per protocol and table
+// Every table is applied even if another one fails, and the first error is returned
+func (p *Portforward) restoreTables(commands map[restoreTable][]string) error {
+	var firstErr error
+	for protocol, ipt := range map[iptables.Protocol]IPTables{iptables.ProtocolIPv4: p.iptables, iptables.ProtocolIPv6: p.ip6tables} {
+		for _, table := range p.tables() {
+			key := restoreTable{protocol, table}
+			if len(commands[key]) == 0 {
 				continue
 			}
 
-			p.createPeerRules(peer, chain.transportProtocol, rules)
+			err := ipt.Restore(table, commands[key])
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
 		}
+	}
 
-		currentRules, err := p.getCurrentRules(chain.name)
+	return firstErr
+}
+
+// PlanPortforwarding returns the changes UpdatePortforwarding would make to the iptables rules for the given list of peers, without applying them
+func (p *Portforward) PlanPortforwarding(peers api.WireguardPeerList) ([]RuleChange, error) {
+	set := p.mapRules(peers)
+
+	var changes []RuleChange
+	for _, chain := range p.chains {
+		chainChanges, err := p.diffChain(chain, set.rules[chain.name])
 		if err != nil {
-			log.Printf("error getting current iptables rules %s", err.Error())
-			return
+			return nil, fmt.Errorf("error getting current iptables rules %s", err.Error())
 		}
 
-		// Add new portforwarding rules
-		for rule, protocol := range rules {
-			if _, ok := currentRules[rule]; !ok {
+		changes = append(changes, chainChanges...)
+	}
 
-				p.insertPeerRule(protocol, table, chain.name, rule)
-				if err != nil {
-					log.Printf("error adding iptables rule")
-					continue
-				}
+	sort.SliceStable(changes, func(i int, j int) bool {
+		if changes[i].Chain != changes[j].Chain {
+			return changes[i].Chain < changes[j].Chain
+		}
 
-			}
+		if changes[i].Protocol != changes[j].Protocol {
+			return changes[i].Protocol < changes[j].Protocol
 		}
 
-		// Remove old portforwarding rules
+		return changes[i].Rule < changes[j].Rule
+	})
+
+	return changes, nil
+}
+
+// Compare the rules of a chain with the given rules, and return the changes needed to make them match
+func (p *Portforward) diffChain(chain Chain, rules map[string]iptables.Protocol) ([]RuleChange, error) {
+	currentRules, err := p.getCurrentRules(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return diffRules(chain, currentRules, rules), nil
+}
+
+// Return the changes needed to go from the current rules of a chain to the given rules
+func diffRules(chain Chain, currentRules map[string]iptables.Protocol, rules map[string]iptables.Protocol) []RuleChange {
+	changes := []RuleChange{}
+
+	// Add new portforwarding rules
+	for rule, protocol := range rules {
+		if _, ok := currentRules[rule]; !ok {
+			changes = append(changes, newRuleChange(protocol, chain.table, chain.name, ActionInsert, rule))
+		}
+	}
+
+	// Remove old portforwarding rules
+	for rule, protocol := range currentRules {
+		if _, ok := rules[rule]; !ok {
+			changes = append(changes, newRuleChange(protocol, chain.table, chain.name, ActionDelete, rule))
+		}
+	}
+
+	return changes
+}
+
+// Batch is a list of portforwarding changes for single peers, which are applied together by Backend.ApplyBatch
+type Batch struct {
+	operations []batchOperation
+}
+
+type batchOperation struct {
+	action string
+	peer   api.WireguardPeer
+}
+
+// Operations of a batch, matching AddPortforwarding, RemovePortforwarding and UpdateSinglePeerPortforwarding
+const (
+	batchAdd    = "add"
+	batchRemove = "remove"
+	batchUpdate = "update"
+)
+
+// NewBatch returns a new empty Batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Add adds the portforwarding rules for a peer, like AddPortforwarding
+func (b *Batch) Add(peer api.WireguardPeer) {
+	b.operations = append(b.operations, batchOperation{action: batchAdd, peer: peer})
+}
+
+// Remove removes the portforwarding rules for a peer, like RemovePortforwarding
+func (b *Batch) Remove(peer api.WireguardPeer) {
+	b.operations = append(b.operations, batchOperation{action: batchRemove, peer: peer})
+}
+
+// Update replaces the portforwarding rules for the addresses of a peer, like UpdateSinglePeerPortforwarding
+func (b *Batch) Update(peer api.WireguardPeer) {
+	b.operations = append(b.operations, batchOperation{action: batchUpdate, peer: peer})
+}
+
+// Len returns the number of changes in the batch
+func (b *Batch) Len() int {
+	return len(b.operations)
+}
+
+// ApplyBatch applies the changes of a batch in order to the current rules, and then applies the result with one iptables-restore transaction per protocol and table
+func (p *Portforward) ApplyBatch(b *Batch) error {
+	var changes []RuleChange
+	for _, chain := range p.chains {
+		currentRules, err := p.getCurrentRules(chain)
+		if err != nil {
+			return fmt.Errorf("error getting current iptables rules %s", err.Error())
+		}
+
+		rules := make(map[string]iptables.Protocol)
 		for rule, protocol := range currentRules {
-			if _, ok := rules[rule]; !ok {
-				ipt := p.iptables
-				if protocol == iptables.ProtocolIPv6 {
-					ipt = p.ip6tables
-				}
+			rules[rule] = protocol
+		}
 
-				err := ipt.Delete(table, chain.name, strings.Split(rule, " ")...)
-				if err != nil {
-					log.Printf("error deleting iptables rule")
-					continue
-				}
+		for _, operation := range b.operations {
+			p.applyBatchOperation(chain, operation, rules)
+		}
 
+		changes = append(changes, diffRules(chain, currentRules, rules)...)
+	}
+
+	return p.restore(changes)
+}
+
+func (p *Portforward) applyBatchOperation(chain Chain, operation batchOperation, rules map[string]iptables.Protocol) {
+	if len(operation.peer.Ports) < 1 {
+		return
+	}
+
+	peerRules := make(map[string]iptables.Protocol)
+	p.createPeerRules(operation.peer, chain, peerRules)
+
+	if operation.action == batchUpdate {
+		// Remove the other rules for the same addresses
+		for peerRule := range peerRules {
+			destination := ruleDestination(peerRule)
+			for rule := range rules {
+				if _, ok := peerRules[rule]; !ok && ruleDestination(rule).Equal(destination) {
+					delete(rules, rule)
+				}
 			}
 		}
 	}
+
+	for peerRule, protocol := range peerRules {
+		switch operation.action {
+		case batchAdd, batchUpdate:
+			rules[peerRule] = protocol
+		case batchRemove:
+			delete(rules, peerRule)
+		}
+	}
+}
+
+// Apply the changes with one iptables-restore transaction per protocol and table
+// Rules are inserted at the start of the chains, which keeps the drop rule of the forward filter chain last
+func (p *Portforward) restore(changes []RuleChange) error {
+	commands := make(map[restoreTable][]string)
+	for _, change := range changes {
+		key := restoreTable{change.protocol, change.Table}
+		switch change.Action {
+		case ActionInsert:
+			commands[key] = append(commands[key], fmt.Sprintf("-I %s 1 %s", change.Chain, change.Rule))
+		case ActionDelete:
+			commands[key] = append(commands[key], fmt.Sprintf("-D %s %s", change.Chain, change.Rule))
+		}
+	}
+
+	err := p.restoreTables(commands)
+	if err != nil {
+		return err
+	}
+
+	for _, change := range changes {
+		if change.Action == ActionInsert {
+			p.setPopulated(change.protocol, change.Chain)
+		}
+	}
+
+	return nil
+}
+
+// Remember that a chain has peer rules in it
+// Removing rules doesn't clear it, which at worst makes bootstrapping report an emptied chain as flushed once
+func (p *Portforward) setPopulated(protocol iptables.Protocol, chain string) {
+	if p.populated == nil {
+		p.populated = make(map[chainKey]bool)
+	}
+
+	p.populated[chainKey{protocol, chain}] = true
 }
 
 // UpdateSinglePeerPortforwarding tries to add portforwarding rules for a peer while also trying to remove old rules for said peer
@@ -197,25 +982,29 @@ func (p *Portforward) UpdateSinglePeerPortforwarding(peer api.WireguardPeer) {
 
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
-		p.createPeerRules(peer, chain.transportProtocol, rules)
+		p.createPeerRules(peer, chain, rules)
 
-		oldRules, err := p.getCurrentRules(chain.name)
+		oldRules, err := p.getCurrentRules(chain)
 		if err != nil {
 			log.Printf("error getting current iptables rules %s", err.Error())
 			return
 		}
 
+		// Add new portforwarding rules
 		for rule, protocol := range rules {
-			// Add new portforwarding rules
-			p.insertPeerRule(protocol, table, chain.name, rule)
+			if _, ok := oldRules[rule]; ok {
+				continue
+			}
+
+			err := p.insertPeerRule(protocol, chain, rule)
 			if err != nil {
 				log.Printf("error adding iptables rule")
 				continue
 			}
-			// Remove old portforwarding rules
-			p.removeOldPeerRules(peer, protocol, table, chain.name, oldRules, rule)
 		}
 
+		// Remove old portforwarding rules
+		p.removeOldPeerRules(peer, chain, oldRules, rules)
 	}
 }
 
@@ -227,10 +1016,10 @@ func (p *Portforward) AddPortforwarding(peer api.WireguardPeer) {
 
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
-		p.createPeerRules(peer, chain.transportProtocol, rules)
+		p.createPeerRules(peer, chain, rules)
 
 		for rule, protocol := range rules {
-			err := p.insertPeerRule(protocol, table, chain.name, rule)
+			err := p.insertPeerRule(protocol, chain, rule)
 			if err != nil {
 				log.Printf("error adding iptables rule")
 			}
@@ -248,7 +1037,7 @@ func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) {
 
 	for _, chain := range p.chains {
 		rules := make(map[string]iptables.Protocol)
-		p.createPeerRules(peer, chain.transportProtocol, rules)
+		p.createPeerRules(peer, chain, rules)
 
 		// Remove old portforwarding rules
 		for rule, protocol := range rules {
@@ -257,7 +1046,7 @@ func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) {
 				ipt = p.ip6tables
 			}
 
-			err := ipt.Delete(table, chain.name, strings.Split(rule, " ")...)
+			err := ipt.Delete(chain.table, chain.name, strings.Split(rule, " ")...)
 			if err != nil {
 				log.Printf("error deleting iptables rule")
 				continue
@@ -266,46 +1055,62 @@ func (p *Portforward) RemovePortforwarding(peer api.WireguardPeer) {
 	}
 }
 
-func (p *Portforward) insertPeerRule(protocol iptables.Protocol, table string, chain string, rule string) error {
+func (p *Portforward) insertPeerRule(protocol iptables.Protocol, chain Chain, rule string) error {
 	ipt := p.iptables
 	if protocol == iptables.ProtocolIPv6 {
 		ipt = p.ip6tables
 	}
 
-	err := ipt.Insert(table, chain, 1, strings.Split(rule, " ")...)
-	return err
+	err := ipt.Insert(chain.table, chain.name, 1, strings.Split(rule, " ")...)
+	if err != nil {
+		return err
+	}
+
+	p.setPopulated(protocol, chain.name)
+
+	return nil
 }
 
-func (p *Portforward) removeOldPeerRules(peer api.WireguardPeer, protocol iptables.Protocol, table string, chain string,
-	oldRules map[string]iptables.Protocol, rule string) {
-	var ipt *iptables.IPTables
-	var peerIP net.IP
+// Remove the old rules of a chain for the addresses of a peer, other than the given new rules
+func (p *Portforward) removeOldPeerRules(peer api.WireguardPeer, chain Chain, oldRules map[string]iptables.Protocol, rules map[string]iptables.Protocol) {
+	ipv4, _, _ := net.ParseCIDR(peer.IPv4)
+	ipv6, _, _ := net.ParseCIDR(peer.IPv6)
 
-	if protocol == iptables.ProtocolIPv6 {
-		ipt = p.ip6tables
-		peerIP, _, _ = net.ParseCIDR(peer.IPv6)
-	} else {
-		ipt = p.iptables
-		peerIP, _, _ = net.ParseCIDR(peer.IPv4)
-	}
-
-	for oldRule := range oldRules {
-		if oldRule != rule {
-			oldRuleSlice := strings.Split(oldRule, " ")
-			oldIP := net.ParseIP(oldRuleSlice[len(oldRuleSlice)-1])
-
-			if oldIP.Equal(peerIP) {
-				err := ipt.Delete(table, chain, strings.Split(oldRule, " ")...)
-				if err != nil {
-					log.Printf("error deleting iptables rule")
-					continue
-				}
+	for oldRule, protocol := range oldRules {
+		if _, ok := rules[oldRule]; ok {
+			continue
+		}
+
+		ipt := p.iptables
+		peerIP := ipv4
+		if protocol == iptables.ProtocolIPv6 {
+			ipt = p.ip6tables
+			peerIP = ipv6
+		}
+
+		if ruleDestination(oldRule).Equal(peerIP) {
+			err := ipt.Delete(chain.table, chain.name, strings.Split(oldRule, " ")...)
+			if err != nil {
+				log.Printf("error deleting iptables rule")
+				continue
 			}
 		}
 	}
 }
 
-func (p *Portforward) createPeerRules(peer api.WireguardPeer, transportProtocol string, rules map[string]iptables.Protocol) {
+// Return the address a rule forwards or accepts traffic to
+func ruleDestination(rule string) net.IP {
+	ruleSlice := strings.Split(rule, " ")
+	for i := 0; i < len(ruleSlice)-1; i++ {
+		if ruleSlice[i] == "--to-destination" || ruleSlice[i] == "-d" {
+			return net.ParseIP(ruleSlice[i+1])
+		}
+	}
+
+	return nil
+}
+
+func (p *Portforward) createPeerRules(peer api.WireguardPeer, chain Chain, rules map[string]iptables.Protocol) {
 	ports := peer.Ports
 	// filter ports if cities are present.
 	if len(peer.Cities) > 0 {
@@ -318,16 +1123,30 @@ func (p *Portforward) createPeerRules(peer api.WireguardPeer, transportProtocol
 		return
 	}
 
-	rule := fmt.Sprintf("-p %s -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", transportProtocol, p.ipsetIPv4, getPortsString(ports), ipv4)
-	rules[rule] = iptables.ProtocolIPv4
+	addPeerRules(chain, ipv4, p.ipsetIPv4, ports, iptables.ProtocolIPv4, rules)
 
 	ipv6, _, err := net.ParseCIDR(peer.IPv6)
 	if err != nil {
 		return
 	}
 
-	rule = fmt.Sprintf("-p %s -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", transportProtocol, p.ipsetIPv6, getPortsString(ports), ipv6)
-	rules[rule] = iptables.ProtocolIPv6
+	addPeerRules(chain, ipv6, p.ipsetIPv6, ports, iptables.ProtocolIPv6, rules)
+}
+
+// Add the rules of a chain for one address of a peer
+// The nat chains forward the ports to the address, and the forward filter chain accepts the forwarded traffic for every transport protocol
+func addPeerRules(chain Chain, address net.IP, ipset string, ports []int, protocol iptables.Protocol, rules map[string]iptables.Protocol) {
+	if chain.table == filterTable {
+		for _, transportProtocol := range transportProtocols {
+			rule := fmt.Sprintf("-d %s -p %s -m multiport --dports %s -j ACCEPT", address, transportProtocol, getPortsString(ports))
+			rules[rule] = protocol
+		}
+
+		return
+	}
+
+	rule := fmt.Sprintf("-p %s -m set --match-set %s dst -m multiport --dports %s -j DNAT --to-destination %s", chain.transportProtocol, ipset, getPortsString(ports), address)
+	rules[rule] = protocol
 }
 
 func getPortsString(ports []int) string {
@@ -362,15 +1181,15 @@ func filterPortsByCity(peer api.WireguardPeer, location string) []int {
 	return ports
 }
 
-func (p *Portforward) getCurrentRules(chain string) (map[string]iptables.Protocol, error) {
+func (p *Portforward) getCurrentRules(chain Chain) (map[string]iptables.Protocol, error) {
 	rules := make(map[string]iptables.Protocol)
 
-	ipv4Rules, err := p.iptables.List("nat", chain)
+	ipv4Rules, err := p.listRules(p.iptables, chain)
 	if err != nil {
 		return nil, err
 	}
 
-	ipv6Rules, err := p.ip6tables.List("nat", chain)
+	ipv6Rules, err := p.listRules(p.ip6tables, chain)
 	if err != nil {
 		return nil, err
 	}
@@ -386,7 +1205,23 @@ func (p *Portforward) getCurrentRules(chain string) (map[string]iptables.Protoco
 	return rules, nil
 }
 
-func (p *Portforward) filterRules(chain string, rules []string) []string {
+// List the rules of a chain, a chain that doesn't exist yet is empty when planning
+func (p *Portforward) listRules(ipt IPTables, chain Chain) ([]string, error) {
+	if p.planning {
+		chains, err := ipt.ListChains(chain.table)
+		if err != nil {
+			return nil, err
+		}
+
+		if !chainExists(chain.name, chains) {
+			return nil, nil
+		}
+	}
+
+	return ipt.List(chain.table, chain.name)
+}
+
+func (p *Portforward) filterRules(chain Chain, rules []string) []string {
 	// Remove the first entry as it's the rule for creating the chain
 	if len(rules) > 0 {
 		rules = rules[1:]
@@ -395,7 +1230,12 @@ func (p *Portforward) filterRules(chain string, rules []string) []string {
 	var filteredRules []string
 	for _, rule := range rules {
 		// Remove the chain name
-		rule = strings.TrimPrefix(rule, fmt.Sprintf("-A %s ", chain))
+		rule = strings.TrimPrefix(rule, fmt.Sprintf("-A %s ", chain.name))
+
+		// The drop rule of the forward filter chain isn't a peer rule, it's kept last in the chain
+		if chain.table == filterTable && rule == forwardDropRule {
+			continue
+		}
 		// Remove the ip masks
 		rule = strings.Replace(rule, "/32", "", -1)
 		rule = strings.Replace(rule, "/128", "", -1)
@@ -0,0 +1,56 @@
+package portforward
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// SystemIPTables is *iptables.IPTables with support for applying several changes in one transaction with iptables-restore
+type SystemIPTables struct {
+	*iptables.IPTables
+
+	restoreCommand string
+}
+
+// NewSystemIPTables returns a new SystemIPTables for the given protocol
+func NewSystemIPTables(protocol iptables.Protocol) (*SystemIPTables, error) {
+	ipt, err := iptables.NewWithProtocol(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreCommand := "iptables-restore"
+	if protocol == iptables.ProtocolIPv6 {
+		restoreCommand = "ip6tables-restore"
+	}
+
+	return &SystemIPTables{
+		IPTables:       ipt,
+		restoreCommand: restoreCommand,
+	}, nil
+}
+
+// Restore applies the given commands, such as -I, -D, -F and -A, to the table in one transaction without flushing it
+// If any of the commands fail, none of them are applied
+func (s *SystemIPTables) Restore(table string, commands []string) error {
+	var input bytes.Buffer
+	fmt.Fprintf(&input, "*%s\n", table)
+	for _, command := range commands {
+		input.WriteString(command + "\n")
+	}
+	input.WriteString("COMMIT\n")
+
+	cmd := exec.Command(s.restoreCommand, "--noflush", "--wait")
+	cmd.Stdin = &input
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %s: %s: %s", s.restoreCommand, err.Error(), strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cursor is a delta synchronization cursor, along with the boot it was saved during
+// A cursor is only valid for as long as the kernel state it describes, so it is discarded after a reboot
+type Cursor struct {
+	Value  string    `json:"cursor"`
+	BootID string    `json:"boot_id"`
+	Time   time.Time `json:"time"`
+}
+
+// Where the kernel exposes a random identifier which changes on every boot
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// LoadCursor reads the cursor stored at path
+// An empty cursor is returned if the file doesn't exist, or if it was saved before the last reboot
+func LoadCursor(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var cursor Cursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return "", err
+	}
+
+	if cursor.BootID != bootID() {
+		return "", nil
+	}
+
+	return cursor.Value, nil
+}
+
+// SaveCursor atomically stores the cursor at path
+func SaveCursor(path string, value string) error {
+	data, err := json.Marshal(Cursor{
+		Value:  value,
+		BootID: bootID(),
+		Time:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, data, 0600)
+}
+
+func bootID() string {
+	data, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
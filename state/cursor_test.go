@@ -0,0 +1,79 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mullvad/wg-manager/state"
+)
+
+func TestCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bootIDPath := filepath.Join(dir, "boot_id")
+	err = ioutil.WriteFile(bootIDPath, []byte("boot-1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.SetBootIDPath(bootIDPath)()
+
+	path := filepath.Join(dir, "cursor")
+
+	t.Run("missing file", func(t *testing.T) {
+		cursor, err := state.LoadCursor(path)
+		if err != nil || cursor != "" {
+			t.Fatalf("expected an empty cursor, got %q %v", cursor, err)
+		}
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		err := state.SaveCursor(path, "abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cursor, err := state.LoadCursor(path)
+		if err != nil || cursor != "abc" {
+			t.Fatalf("expected the saved cursor, got %q %v", cursor, err)
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 2 {
+			t.Fatalf("temporary files were left behind: %+v", files)
+		}
+	})
+
+	t.Run("after reboot", func(t *testing.T) {
+		err := ioutil.WriteFile(bootIDPath, []byte("boot-2\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cursor, err := state.LoadCursor(path)
+		if err != nil || cursor != "" {
+			t.Fatalf("expected an empty cursor, got %q %v", cursor, err)
+		}
+	})
+
+	t.Run("corrupt file", func(t *testing.T) {
+		err := ioutil.WriteFile(path, []byte("{"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = state.LoadCursor(path)
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
@@ -0,0 +1,11 @@
+package state
+
+// SetBootIDPath replaces the path the boot id is read from, and returns a function restoring it
+func SetBootIDPath(path string) func() {
+	previous := bootIDPath
+	bootIDPath = path
+
+	return func() {
+		bootIDPath = previous
+	}
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+)
+
+// ErrPeerCacheStale is returned by ReadPeerCache when the cached list of peers is older than the max age
+var ErrPeerCacheStale = errors.New("cached wireguard peers are too old")
+
+// PeerCacheWriter writes a list of wireguard peers to a file one peer at a time, replacing the file atomically once committed
+type PeerCacheWriter struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	count  int
+	err    error
+}
+
+// CreatePeerCache starts writing a new list of wireguard peers to be stored at path
+func CreatePeerCache(path string) (*PeerCacheWriter, error) {
+	f, err := createTemp(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &PeerCacheWriter{
+		path:   path,
+		file:   f,
+		writer: bufio.NewWriter(f),
+	}
+	w.write([]byte("["))
+
+	return w, nil
+}
+
+// Add appends a peer to the list
+func (w *PeerCacheWriter) Add(peer api.WireguardPeer) error {
+	data, err := json.Marshal(peer)
+	if err != nil {
+		return err
+	}
+
+	if w.count > 0 {
+		w.write([]byte(","))
+	}
+	w.write(data)
+	w.count++
+
+	return w.err
+}
+
+// Commit finishes the list, and replaces the file at path with it
+func (w *PeerCacheWriter) Commit() error {
+	defer os.Remove(w.file.Name())
+
+	w.write([]byte("]"))
+	if w.err == nil {
+		w.err = w.writer.Flush()
+	}
+
+	if w.err != nil {
+		w.file.Close()
+		return w.err
+	}
+
+	return commit(w.file, w.path, 0600)
+}
+
+// Abort discards the list, leaving the file at path untouched
+func (w *PeerCacheWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (w *PeerCacheWriter) write(data []byte) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = w.writer.Write(data)
+}
+
+// ReadPeerCache decodes the list of wireguard peers stored at path one at a time, and calls fn for each peer
+// If the list was stored more than maxAge ago, ErrPeerCacheStale is returned without calling fn
+func ReadPeerCache(path string, maxAge time.Duration, fn func(api.WireguardPeer) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if time.Since(info.ModTime()) > maxAge {
+		return ErrPeerCacheStale
+	}
+
+	return api.DecodeWireguardPeers(bufio.NewReader(f), fn)
+}
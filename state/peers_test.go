@@ -0,0 +1,141 @@
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/state"
+)
+
+var peersFixture = api.WireguardPeerList{
+	api.WireguardPeer{
+		IPv4:   "10.99.0.1/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+		Ports:  []int{1234, 4321},
+		Cities: []string{"se-mma", ""},
+		Pubkey: strings.Repeat("a", 44),
+	},
+	api.WireguardPeer{
+		IPv4:   "10.99.0.2/32",
+		IPv6:   "fc00:bbbb:bbbb:bb01::2/128",
+		Pubkey: strings.Repeat("b", 44),
+	},
+}
+
+func writePeerCache(t *testing.T, path string, peers api.WireguardPeerList) {
+	t.Helper()
+
+	w, err := state.CreatePeerCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, peer := range peers {
+		err = w.Add(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = w.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readPeerCache(path string, maxAge time.Duration) (api.WireguardPeerList, error) {
+	peers := api.WireguardPeerList{}
+	err := state.ReadPeerCache(path, maxAge, func(peer api.WireguardPeer) error {
+		peers = append(peers, peer)
+		return nil
+	})
+
+	return peers, err
+}
+
+func TestPeerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "peers.json")
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := readPeerCache(path, time.Hour)
+		if !os.IsNotExist(err) {
+			t.Fatalf("expected a not exist error, got %v", err)
+		}
+	})
+
+	t.Run("write and read", func(t *testing.T) {
+		writePeerCache(t, path, peersFixture)
+
+		peers, err := readPeerCache(path, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peersFixture) {
+			t.Errorf("got unexpected result, wanted %+v, got %+v", peersFixture, peers)
+		}
+	})
+
+	t.Run("empty list", func(t *testing.T) {
+		emptyPath := filepath.Join(dir, "empty.json")
+		writePeerCache(t, emptyPath, api.WireguardPeerList{})
+
+		peers, err := readPeerCache(emptyPath, time.Hour)
+		if err != nil || len(peers) != 0 {
+			t.Fatalf("expected no peers, got %+v %v", peers, err)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		w, err := state.CreatePeerCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w.Add(peersFixture[0])
+		w.Abort()
+
+		peers, err := readPeerCache(path, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peers, peersFixture) {
+			t.Errorf("aborted write replaced the cache, got %+v", peers)
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 2 {
+			t.Fatalf("temporary files were left behind: %+v", files)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		old := time.Now().Add(-time.Hour * 2)
+		err := os.Chtimes(path, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = readPeerCache(path, time.Hour)
+		if err != state.ErrPeerCacheStale {
+			t.Fatalf("expected the cache to be stale, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temporary file next to path, and renames it over path once it's been synced to disk
+// This ensures that readers either see the previous or the new contents of the file, never a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+
+	// Clean up the temporary file if anything fails, this is a no-op after the rename
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return commit(f, path, perm)
+}
+
+// Create a temporary file in the same directory as path, so that it can be renamed over it
+func createTemp(path string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+}
+
+// Sync and close the temporary file, and rename it over path
+func commit(f *os.File, path string, perm os.FileMode) error {
+	err := f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(f.Name(), perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
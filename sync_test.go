@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/infosum/statsd"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/portforward"
+	"github.com/mullvad/wg-manager/wireguard"
+)
+
+var syncPeer = api.WireguardPeer{IPv4: "10.99.0.1/32", IPv6: "fc00:bbbb:bbbb:bb01::1/128", Ports: []int{1234}, Pubkey: planPubkey}
+
+// Serve the API with the given handler, and synchronize against an in-memory interface and iptables
+func setupSync(t *testing.T, handler http.HandlerFunc) *wireguard.MemoryDevice {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	a = &api.API{BaseURL: server.URL, Client: server.Client()}
+
+	var err error
+	metrics, err = statsd.New(statsd.Mute(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := wireguard.NewMemoryDevice("wg0")
+	wg, err = wireguard.NewWithDevice(device, []string{"wg0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ipts []*portforward.MemoryIPTables
+	for _, protocol := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt := portforward.NewMemoryIPTables(protocol)
+		for _, chain := range portforward.ChainNames("PORTFORWARDING") {
+			if err := ipt.NewChain("nat", chain); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ipts = append(ipts, ipt)
+	}
+
+	pf, err = portforward.NewWithIPTables(ipts[0], ipts[1], "PORTFORWARDING", "PORTFORWARDING_IPV4", "PORTFORWARDING_IPV6", "se-got")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bootstrap, exits = nil, nil
+	cursor, cursorPath, peerCachePath = "", "", ""
+	reportedRejections = make(map[api.PeerRejection]bool)
+
+	return device
+}
+
+func getSyncPeers(t *testing.T, device *wireguard.MemoryDevice) int {
+	t.Helper()
+
+	d, err := device.Device("wg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(d.Peers)
+}
+
+func TestDeltaSynchronizeRemoveKey(t *testing.T) {
+	device := setupSync(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since") == "" {
+			json.NewEncoder(w).Encode(api.WireguardPeerList{syncPeer})
+			return
+		}
+
+		// The removed peer only has its public key
+		json.NewEncoder(w).Encode(api.WireguardPeerDelta{
+			Cursor:  "2",
+			Removed: api.WireguardPeerList{{Pubkey: syncPeer.Pubkey}},
+		})
+	})
+
+	if err := synchronize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := getSyncPeers(t, device); n != 1 {
+		t.Fatalf("expected 1 peer, got %d", n)
+	}
+
+	cursor = "1"
+	deltaSynchronize()
+
+	if n := getSyncPeers(t, device); n != 0 {
+		t.Fatalf("the removed peer wasn't removed, got %d peers", n)
+	}
+
+	if cursor != "2" {
+		t.Fatalf("unexpected cursor %s", cursor)
+	}
+}
+
+func TestInitialSynchronizePeerCache(t *testing.T) {
+	var failing int32
+	setupSync(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(api.WireguardPeerList{syncPeer})
+	})
+
+	// Applying the peers fails on wg1, but succeeds on wg0
+	device := wireguard.NewMemoryDevice("wg0", "wg1")
+	var err error
+	wg, err = wireguard.NewWithDevice(device, []string{"wg0", "wg1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	device.SetError("wg1", errors.New("broken"))
+
+	peerCachePath = filepath.Join(t.TempDir(), "peers.json")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	t.Run("apply error", func(t *testing.T) {
+		err := synchronize()
+		if !errors.Is(err, errApplyingPeers) {
+			t.Fatalf("expected an error applying peers, got %v", err)
+		}
+
+		logs.Reset()
+		initialSynchronize(time.Hour)
+
+		if strings.Contains(logs.String(), "peer cache") {
+			t.Fatalf("the peer cache was restored even though the API answered:\n%s", logs.String())
+		}
+	})
+
+	t.Run("fetch error", func(t *testing.T) {
+		atomic.StoreInt32(&failing, 1)
+		a.ResetConditionalRequests()
+
+		err := synchronize()
+		if err == nil || errors.Is(err, errApplyingPeers) {
+			t.Fatalf("expected an error getting peers, got %v", err)
+		}
+
+		logs.Reset()
+		initialSynchronize(time.Hour)
+
+		if !strings.Contains(logs.String(), "restored 1 peers from the peer cache") {
+			t.Fatalf("the peer cache wasn't restored:\n%s", logs.String())
+		}
+	})
+}
+
+func TestReportRejections(t *testing.T) {
+	var mu sync.Mutex
+	var reports [][]api.PeerRejection
+	invalid := api.WireguardPeer{IPv4: "10.99.0.2/32", IPv6: "fc00:bbbb:bbbb:bb01::2/128", Pubkey: "invalid"}
+	peers := api.WireguardPeerList{syncPeer, invalid}
+
+	setupSync(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/internal/wireguard-peer-rejection-report/" {
+			var report struct {
+				Rejections []api.PeerRejection `json:"rejections"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+				t.Error(err)
+			}
+
+			reports = append(reports, report.Rejections)
+			return
+		}
+
+		json.NewEncoder(w).Encode(peers)
+	})
+
+	setPeers := func(p ...api.WireguardPeer) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		peers = p
+	}
+
+	synchronizeReports := func(t *testing.T, want int) {
+		t.Helper()
+
+		if err := synchronize(); err != nil {
+			t.Fatal(err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if len(reports) != want {
+			t.Fatalf("expected %d reports, got %+v", want, reports)
+		}
+	}
+
+	t.Run("reported once", func(t *testing.T) {
+		synchronizeReports(t, 1)
+		synchronizeReports(t, 1)
+
+		if len(reports[0]) != 1 || reports[0][0].Pubkey != "invalid" {
+			t.Fatalf("unexpected report %+v", reports[0])
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		changed := invalid
+		changed.Pubkey = "changed"
+		setPeers(syncPeer, changed)
+
+		synchronizeReports(t, 2)
+		synchronizeReports(t, 2)
+
+		if len(reports[1]) != 1 || reports[1][0].Pubkey != "changed" {
+			t.Fatalf("unexpected report %+v", reports[1])
+		}
+	})
+
+	t.Run("fixed and broken again", func(t *testing.T) {
+		setPeers(syncPeer)
+		synchronizeReports(t, 2)
+
+		setPeers(syncPeer, invalid)
+		synchronizeReports(t, 3)
+	})
+}
@@ -0,0 +1,196 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Config contains the files and pins used to set up TLS connections to the API and message-queue
+// All fields are optional, empty fields fall back to the default behaviour of crypto/tls
+type Config struct {
+	// Client certificate and key in PEM format
+	CertFile string
+	KeyFile  string
+
+	// CA bundle in PEM format used to verify servers instead of the system roots
+	CAFile string
+
+	// Base64 encoded SHA-256 hashes of the SubjectPublicKeyInfo of the allowed server certificates
+	PinnedPublicKeys []string
+}
+
+// New returns a *tls.Config for the given configuration
+// The certificate, key and CA bundle are reloaded from disk whenever they change, so they can be rotated without a restart
+func New(c Config) (*tls.Config, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("both a certificate and a key have to be configured")
+	}
+
+	pins := make(map[string]bool)
+	for _, pin := range c.PinnedPublicKeys {
+		decoded, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned public key %s", pin)
+		}
+
+		pins[pin] = true
+	}
+
+	r := &reloader{
+		config: c,
+	}
+
+	// Load the files once up front, to fail early on invalid configuration
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.CertFile != "" {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _, err := r.current()
+			return certificate, err
+		}
+	}
+
+	if c.CAFile != "" || len(pins) > 0 {
+		// Verification is done in VerifyConnection instead, so that the CA bundle can be reloaded
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return r.verify(cs, pins)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Keeps track of the files in a Config, and reloads them when their modification time changes
+type reloader struct {
+	config Config
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// Return the current certificate and CA pool, reloading them if they've changed
+// If reloading fails, for example while the files are being replaced, the previously loaded ones are used
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool, error) {
+	err := r.reload()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil && r.modTimes == nil {
+		return nil, nil, err
+	}
+
+	return r.cert, r.roots, nil
+}
+
+func (r *reloader) verify(cs tls.ConnectionState, pins map[string]bool) error {
+	_, roots, err := r.current()
+	if err != nil {
+		return err
+	}
+
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	// A nil pool means the system roots are used
+	_, err = cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(pins) == 0 {
+		return nil
+	}
+
+	for _, cert := range cs.PeerCertificates {
+		hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if pins[base64.StdEncoding.EncodeToString(hash[:])] {
+			return nil
+		}
+	}
+
+	return errors.New("server public key does not match any pinned public key")
+}
+
+// Reload the files if any of them have changed since they were last loaded
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	changed := r.modTimes == nil
+	for _, path := range []string{r.config.CertFile, r.config.KeyFile, r.config.CAFile} {
+		if path == "" {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		modTimes[path] = info.ModTime()
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if r.config.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading client certificate: %s", err.Error())
+		}
+
+		r.cert = &certificate
+	}
+
+	if r.config.CAFile != "" {
+		data, err := ioutil.ReadFile(r.config.CAFile)
+		if err != nil {
+			return err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.config.CAFile)
+		}
+
+		r.roots = roots
+	}
+
+	r.modTimes = modTimes
+
+	return nil
+}
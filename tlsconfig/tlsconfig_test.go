@@ -0,0 +1,258 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mullvad/wg-manager/tlsconfig"
+)
+
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newKeyPair(t *testing.T, name string, parent *keyPair) *keyPair {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &keyPair{cert: cert, key: key, der: der}
+}
+
+func (k *keyPair) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{k.der},
+		PrivateKey:  k.key,
+	}
+}
+
+func (k *keyPair) pin() string {
+	hash := sha256.Sum256(k.cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Write the certificate and key in PEM format with the given modification time, which is what triggers a reload
+func (k *keyPair) write(t *testing.T, certPath string, keyPath string, modTime time.Time) {
+	t.Helper()
+
+	err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: k.der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wg-manager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newKeyPair(t, "ca", nil)
+	serverCert := newKeyPair(t, "server", ca)
+	clientCert := newKeyPair(t, "client-1", ca)
+
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	caPath := filepath.Join(dir, "ca.crt")
+	otherCAPath := filepath.Join(dir, "other-ca.crt")
+
+	clientCert.write(t, certPath, keyPath, time.Now())
+	ca.write(t, caPath, filepath.Join(dir, "ca.key"), time.Now())
+	newKeyPair(t, "other-ca", nil).write(t, otherCAPath, filepath.Join(dir, "other-ca.key"), time.Now())
+
+	// The server only accepts the client certificate with the expected name
+	var mu sync.Mutex
+	expectedClient := "client-1"
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if verifiedChains[0][0].Subject.CommonName != expectedClient {
+				return errors.New("unexpected client")
+			}
+
+			return nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(c tlsconfig.Config) error {
+		tlsConfig, err := tlsconfig.New(c)
+		if err != nil {
+			return err
+		}
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				DisableKeepAlives: true,
+			},
+		}
+
+		response, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+
+		return response.Body.Close()
+	}
+
+	t.Run("client certificate and ca", func(t *testing.T) {
+		err := get(tlsconfig.Config{CertFile: certPath, KeyFile: keyPath, CAFile: caPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("without client certificate", func(t *testing.T) {
+		err := get(tlsconfig.Config{CAFile: caPath})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("wrong ca", func(t *testing.T) {
+		err := get(tlsconfig.Config{CertFile: certPath, KeyFile: keyPath, CAFile: otherCAPath})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("pinned public key", func(t *testing.T) {
+		err := get(tlsconfig.Config{CertFile: certPath, KeyFile: keyPath, CAFile: caPath, PinnedPublicKeys: []string{clientCert.pin(), serverCert.pin()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("wrong pinned public key", func(t *testing.T) {
+		err := get(tlsconfig.Config{CertFile: certPath, KeyFile: keyPath, CAFile: caPath, PinnedPublicKeys: []string{clientCert.pin()}})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("invalid pinned public key", func(t *testing.T) {
+		_, err := tlsconfig.New(tlsconfig.Config{PinnedPublicKeys: []string{"invalid"}})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := tlsconfig.New(tlsconfig.Config{CertFile: certPath})
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("certificate rotation", func(t *testing.T) {
+		tlsConfig, err := tlsconfig.New(tlsconfig.Config{CertFile: certPath, KeyFile: keyPath, CAFile: caPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				DisableKeepAlives: true,
+			},
+		}
+
+		mu.Lock()
+		expectedClient = "client-2"
+		mu.Unlock()
+
+		_, err = client.Get(server.URL)
+		if err == nil {
+			t.Fatal("old certificate was accepted")
+		}
+
+		newKeyPair(t, "client-2", ca).write(t, certPath, keyPath, time.Now().Add(time.Minute))
+
+		response, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+	})
+}
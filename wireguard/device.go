@@ -0,0 +1,13 @@
+package wireguard
+
+import (
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Device is the set of operations used to read and configure wireguard interfaces
+// It is implemented by *wgctrl.Client, and by MemoryDevice for testing without a kernel
+type Device interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
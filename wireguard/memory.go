@@ -0,0 +1,220 @@
+package wireguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MemoryDevice is an in-memory implementation of Device, which keeps the peers of each interface in a map
+// It allows handshake times and errors to be faked
+// If Log is set, every peer change is written to it as a JSON object on a separate line
+// If RecordCalls is set, every call to ConfigureDevice is kept until ResetCalls, which is only meant for tests as the calls are never cleared otherwise
+type MemoryDevice struct {
+	Log         io.Writer
+	RecordCalls bool
+
+	mu         sync.Mutex
+	interfaces map[string]map[wgtypes.Key]*wgtypes.Peer
+	errors     map[string]error
+	calls      []ConfigureCall
+}
+
+// ConfigureCall is a recorded call to MemoryDevice.ConfigureDevice
+type ConfigureCall struct {
+	Name   string
+	Config wgtypes.Config
+}
+
+// NewMemoryDevice returns a new MemoryDevice with the given interfaces, without any peers
+func NewMemoryDevice(interfaces ...string) *MemoryDevice {
+	m := &MemoryDevice{
+		interfaces: make(map[string]map[wgtypes.Key]*wgtypes.Peer),
+		errors:     make(map[string]error),
+	}
+
+	for _, i := range interfaces {
+		m.interfaces[i] = make(map[wgtypes.Key]*wgtypes.Peer)
+	}
+
+	return m
+}
+
+// Device returns the interface with the given name, with its peers sorted by public key
+func (m *MemoryDevice) Device(name string) (*wgtypes.Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	device := &wgtypes.Device{
+		Name: name,
+		Type: wgtypes.LinuxKernel,
+	}
+
+	for _, peer := range peers {
+		p := *peer
+		p.AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+		device.Peers = append(device.Peers, p)
+	}
+
+	sort.Slice(device.Peers, func(i int, j int) bool {
+		return bytes.Compare(device.Peers[i].PublicKey[:], device.Peers[j].PublicKey[:]) < 0
+	})
+
+	return device, nil
+}
+
+// ConfigureDevice records the call if RecordCalls is set, and applies the peer changes of the given configuration to the interface
+func (m *MemoryDevice) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.RecordCalls {
+		m.calls = append(m.calls, ConfigureCall{
+			Name:   name,
+			Config: cfg,
+		})
+	}
+
+	peers, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ReplacePeers {
+		for key := range peers {
+			delete(peers, key)
+			m.log(name, ActionRemove, key, nil)
+		}
+	}
+
+	for _, pc := range cfg.Peers {
+		if pc.Remove {
+			if _, ok := peers[pc.PublicKey]; ok {
+				delete(peers, pc.PublicKey)
+				m.log(name, ActionRemove, pc.PublicKey, nil)
+			}
+			continue
+		}
+
+		action := ActionUpdate
+
+		peer, ok := peers[pc.PublicKey]
+		if !ok {
+			if pc.UpdateOnly {
+				continue
+			}
+
+			peer = &wgtypes.Peer{
+				PublicKey:       pc.PublicKey,
+				ProtocolVersion: 1,
+			}
+			peers[pc.PublicKey] = peer
+			action = ActionAdd
+		}
+
+		if pc.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+
+		peer.AllowedIPs = append(peer.AllowedIPs, pc.AllowedIPs...)
+		m.log(name, action, pc.PublicKey, peer.AllowedIPs)
+	}
+
+	return nil
+}
+
+// SetHandshake fakes the last handshake time of a peer
+func (m *MemoryDevice) SetHandshake(name string, key wgtypes.Key, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	peers, ok := m.interfaces[name]
+	if !ok {
+		return fmt.Errorf("interface %s does not exist", name)
+	}
+
+	peer, ok := peers[key]
+	if !ok {
+		return fmt.Errorf("peer %s does not exist on interface %s", key, name)
+	}
+
+	peer.LastHandshakeTime = t
+
+	return nil
+}
+
+// SetError makes all subsequent calls for the given interface fail with err, pass nil to clear it
+func (m *MemoryDevice) SetError(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err == nil {
+		delete(m.errors, name)
+		return
+	}
+
+	m.errors[name] = err
+}
+
+// Calls returns the calls made to ConfigureDevice so far, if RecordCalls is set
+func (m *MemoryDevice) Calls() []ConfigureCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]ConfigureCall(nil), m.calls...)
+}
+
+// ResetCalls clears the recorded calls to ConfigureDevice
+func (m *MemoryDevice) ResetCalls() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls = nil
+}
+
+// Close does nothing, it exists to implement Device
+func (m *MemoryDevice) Close() error {
+	return nil
+}
+
+func (m *MemoryDevice) lookup(name string) (map[wgtypes.Key]*wgtypes.Peer, error) {
+	if err, ok := m.errors[name]; ok {
+		return nil, err
+	}
+
+	peers, ok := m.interfaces[name]
+	if !ok {
+		return nil, fmt.Errorf("interface %s does not exist", name)
+	}
+
+	return peers, nil
+}
+
+func (m *MemoryDevice) log(name string, action string, key wgtypes.Key, allowedIPs []net.IPNet) {
+	if m.Log == nil {
+		return
+	}
+
+	json.NewEncoder(m.Log).Encode(struct {
+		Time time.Time `json:"time"`
+		PeerChange
+	}{
+		Time: time.Now(),
+		PeerChange: newPeerChange(name, action, wgtypes.PeerConfig{
+			PublicKey:  key,
+			AllowedIPs: allowedIPs,
+		}),
+	})
+}
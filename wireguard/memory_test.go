@@ -0,0 +1,325 @@
+package wireguard_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/mullvad/wg-manager/api"
+	"github.com/mullvad/wg-manager/wireguard"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Tests for the wireguard logic using an in-memory device, these run in short mode
+
+var memoryFixture = api.WireguardPeer{
+	IPv4:   "10.99.0.1/32",
+	IPv6:   "fc00:bbbb:bbbb:bb01::1/128",
+	Ports:  []int{1234, 4321},
+	Pubkey: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
+}
+
+var memoryAllowedIPs = []net.IPNet{
+	{IP: net.ParseIP("10.99.0.1").To4(), Mask: net.CIDRMask(32, 32)},
+	{IP: net.ParseIP("fc00:bbbb:bbbb:bb01::1"), Mask: net.CIDRMask(128, 128)},
+}
+
+func newMemoryWireguard(t *testing.T, interfaces ...string) (*wireguard.Wireguard, *wireguard.MemoryDevice) {
+	t.Helper()
+
+	device := wireguard.NewMemoryDevice(interfaces...)
+	device.RecordCalls = true
+	wg, err := wireguard.NewWithDevice(device, interfaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return wg, device
+}
+
+func getPeers(t *testing.T, device *wireguard.MemoryDevice, name string) []wgtypes.Peer {
+	t.Helper()
+
+	d, err := device.Device(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d.Peers
+}
+
+func TestMemoryUpdatePeers(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0", "wg1")
+
+	t.Run("add peers", func(t *testing.T) {
+		wg.UpdatePeers(api.WireguardPeerList{memoryFixture})
+
+		want := []wgtypes.Peer{{
+			PublicKey:       wgKey(),
+			AllowedIPs:      memoryAllowedIPs,
+			ProtocolVersion: 1,
+		}}
+
+		for _, name := range []string{"wg0", "wg1"} {
+			if diff := cmp.Diff(want, getPeers(t, device, name)); diff != "" {
+				t.Fatalf("unexpected peers on %s (-want +got):\n%s", name, diff)
+			}
+		}
+
+		if len(device.Calls()) != 2 {
+			t.Fatalf("expected one call per interface, got %d", len(device.Calls()))
+		}
+	})
+
+	t.Run("no changes", func(t *testing.T) {
+		device.ResetCalls()
+		wg.UpdatePeers(api.WireguardPeerList{memoryFixture})
+
+		if len(device.Calls()) != 0 {
+			t.Fatalf("expected no calls, got %+v", device.Calls())
+		}
+	})
+
+	t.Run("update peer ip", func(t *testing.T) {
+		updated := memoryFixture
+		updated.IPv4 = "10.99.0.2/32"
+		wg.UpdatePeers(api.WireguardPeerList{updated})
+
+		peers := getPeers(t, device, "wg0")
+		if len(peers) != 1 || !peers[0].AllowedIPs[0].IP.Equal(net.ParseIP("10.99.0.2")) {
+			t.Fatalf("peer was not updated, got %+v", peers)
+		}
+	})
+
+	t.Run("ignore invalid peers", func(t *testing.T) {
+		invalid := memoryFixture
+		invalid.Pubkey = "invalid"
+		wg.UpdatePeers(api.WireguardPeerList{memoryFixture, invalid})
+
+		if len(getPeers(t, device, "wg0")) != 1 {
+			t.Fatal("invalid peer was added")
+		}
+	})
+
+	t.Run("remove peers", func(t *testing.T) {
+		wg.UpdatePeers(api.WireguardPeerList{})
+
+		for _, name := range []string{"wg0", "wg1"} {
+			if peers := getPeers(t, device, name); len(peers) != 0 {
+				t.Fatalf("unexpected peers on %s: %+v", name, peers)
+			}
+		}
+	})
+}
+
+func TestMemoryBrokenInterface(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0", "wg1")
+	device.SetError("wg0", errors.New("broken"))
+
+	wg.UpdatePeers(api.WireguardPeerList{memoryFixture})
+
+	set := wireguard.NewPeerSet()
+	set.Add(memoryFixture)
+
+	err := wg.UpdatePeerSet(set)
+	if err == nil {
+		t.Fatal("no error for a broken interface")
+	}
+
+	wg.AddPeer(memoryFixture)
+
+	if len(getPeers(t, device, "wg1")) != 1 {
+		t.Fatal("a broken interface prevented the other interfaces from being configured")
+	}
+
+	_, count := wg.CountPeers()
+	if count != 0 {
+		t.Fatalf("unexpected peer count %d", count)
+	}
+
+	device.SetError("wg0", nil)
+	if len(getPeers(t, device, "wg0")) != 0 {
+		t.Fatal("broken interface was configured")
+	}
+}
+
+func TestMemoryCountPeers(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0", "wg1")
+	wg.AddPeer(memoryFixture)
+
+	connectedKeys, count := wg.CountPeers()
+	if count != 0 || len(connectedKeys) != 0 {
+		t.Fatalf("peers without handshakes were counted, got %d %+v", count, connectedKeys)
+	}
+
+	// Connected on wg0, recently disconnected on wg1
+	device.SetHandshake("wg0", wgKey(), time.Now())
+	device.SetHandshake("wg1", wgKey(), time.Now().Add(-time.Second*150))
+
+	connectedKeys, count = wg.CountPeers()
+	if count != 1 {
+		t.Fatalf("unexpected peer count %d", count)
+	}
+
+	want := api.ConnectedKeysMap{memoryFixture.Pubkey: 2}
+	if diff := cmp.Diff(want, connectedKeys); diff != "" {
+		t.Fatalf("unexpected keys (-want +got):\n%s", diff)
+	}
+}
+
+func TestMemoryResetPeers(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0")
+	wg.AddPeer(memoryFixture)
+
+	t.Run("active peer", func(t *testing.T) {
+		device.SetHandshake("wg0", wgKey(), time.Now())
+		device.ResetCalls()
+		wg.ResetPeers()
+
+		if len(device.Calls()) != 0 {
+			t.Fatalf("active peer was reset: %+v", device.Calls())
+		}
+	})
+
+	t.Run("inactive peer", func(t *testing.T) {
+		device.SetHandshake("wg0", wgKey(), time.Now().Add(-time.Minute*5))
+		device.ResetCalls()
+		wg.ResetPeers()
+
+		if len(device.Calls()) != 2 {
+			t.Fatalf("expected a remove and an add call, got %+v", device.Calls())
+		}
+
+		peers := getPeers(t, device, "wg0")
+		if len(peers) != 1 || !peers[0].LastHandshakeTime.IsZero() {
+			t.Fatalf("peer was not reset, got %+v", peers)
+		}
+
+		if diff := cmp.Diff(memoryAllowedIPs, peers[0].AllowedIPs); diff != "" {
+			t.Fatalf("unexpected allowed ips (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMemoryRemovePeer(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0", "wg1")
+	wg.AddPeer(memoryFixture)
+	wg.RemovePeer(memoryFixture)
+
+	for _, name := range []string{"wg0", "wg1"} {
+		if peers := getPeers(t, device, name); len(peers) != 0 {
+			t.Fatalf("unexpected peers on %s: %+v", name, peers)
+		}
+	}
+}
+
+func TestMemoryRemovePeerKey(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0", "wg1")
+	wg.AddPeer(memoryFixture)
+
+	// A removed peer without addresses is still removed by its key
+	wg.RemovePeer(api.WireguardPeer{Pubkey: memoryFixture.Pubkey})
+
+	for _, name := range []string{"wg0", "wg1"} {
+		if peers := getPeers(t, device, name); len(peers) != 0 {
+			t.Fatalf("unexpected peers on %s: %+v", name, peers)
+		}
+	}
+
+	wg.AddPeer(memoryFixture)
+	wg.RemovePeerKey(memoryFixture.Pubkey)
+
+	for _, name := range []string{"wg0", "wg1"} {
+		if peers := getPeers(t, device, name); len(peers) != 0 {
+			t.Fatalf("unexpected peers on %s: %+v", name, peers)
+		}
+	}
+}
+
+func TestMemoryCallsNotRecorded(t *testing.T) {
+	device := wireguard.NewMemoryDevice("wg0")
+	wg, err := wireguard.NewWithDevice(device, []string{"wg0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg.AddPeer(memoryFixture)
+
+	if calls := device.Calls(); len(calls) != 0 {
+		t.Fatalf("calls were recorded without RecordCalls: %+v", calls)
+	}
+
+	if peers := getPeers(t, device, "wg0"); len(peers) != 1 {
+		t.Fatalf("expected 1 peer, got %+v", peers)
+	}
+}
+
+func TestMemoryInvalidInterface(t *testing.T) {
+	_, err := wireguard.NewWithDevice(wireguard.NewMemoryDevice("wg0"), []string{"nonexistant"})
+	if err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestMemoryPlanPeers(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0")
+
+	removed := memoryFixture
+	removed.Pubkey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+	wg.AddPeer(removed)
+	device.ResetCalls()
+
+	changes, err := wg.PlanPeers(api.WireguardPeerList{memoryFixture})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []wireguard.PeerChange{
+		{
+			Interface:  "wg0",
+			Action:     wireguard.ActionAdd,
+			PublicKey:  memoryFixture.Pubkey,
+			AllowedIPs: []string{"10.99.0.1/32", "fc00:bbbb:bbbb:bb01::1/128"},
+		},
+		{
+			Interface: "wg0",
+			Action:    wireguard.ActionRemove,
+			PublicKey: removed.Pubkey,
+		},
+	}
+
+	if diff := cmp.Diff(want, changes, cmpopts.IgnoreUnexported(wireguard.PeerChange{})); diff != "" {
+		t.Fatalf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	if len(device.Calls()) != 0 {
+		t.Fatalf("plan configured the device: %+v", device.Calls())
+	}
+}
+
+func TestMemoryApplyPeers(t *testing.T) {
+	wg, device := newMemoryWireguard(t, "wg0", "wg1")
+
+	removed := memoryFixture
+	removed.Pubkey = base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+	wg.AddPeer(removed)
+	device.ResetCalls()
+
+	wg.ApplyPeers(api.WireguardPeerList{memoryFixture}, api.WireguardPeerList{removed})
+
+	if len(device.Calls()) != 2 {
+		t.Fatalf("expected one call per interface, got %d", len(device.Calls()))
+	}
+
+	for _, name := range []string{"wg0", "wg1"} {
+		peers := getPeers(t, device, name)
+		if len(peers) != 1 || peers[0].PublicKey != wgKey() {
+			t.Fatalf("unexpected peers on %s: %+v", name, peers)
+		}
+	}
+}
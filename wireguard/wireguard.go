@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/mullvad/wg-manager/api"
@@ -15,17 +16,28 @@ import (
 
 // Wireguard is a utility for managing wireguard configuration
 type Wireguard struct {
-	client     *wgctrl.Client
+	client     Device
 	interfaces []string
 }
 
-// New ensures that the interfaces given are valid, and returns a new Wireguard instance
+// New ensures that the interfaces given are valid, and returns a new Wireguard instance backed by the kernel
 func New(interfaces []string) (*Wireguard, error) {
 	client, err := wgctrl.New()
 	if err != nil {
 		return nil, err
 	}
 
+	w, err := NewWithDevice(client, interfaces)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// NewWithDevice ensures that the interfaces given are valid, and returns a new Wireguard instance using the given device
+func NewWithDevice(client Device, interfaces []string) (*Wireguard, error) {
 	for _, i := range interfaces {
 		_, err := client.Device(i)
 		if err != nil {
@@ -121,52 +133,101 @@ func (w *Wireguard) CountPeers() (connectedKeyList api.ConnectedKeysMap, peerCou
 	return connectedKeysMap, peerCount
 }
 
+// PeerChange is a change to a peer on a wireguard interface
+type PeerChange struct {
+	Interface  string   `json:"interface"`
+	Action     string   `json:"action"`
+	PublicKey  string   `json:"public_key"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+
+	config wgtypes.PeerConfig
+}
+
+// Actions of a PeerChange
+const (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionRemove = "remove"
+)
+
+func newPeerChange(d string, action string, config wgtypes.PeerConfig) PeerChange {
+	change := PeerChange{
+		Interface: d,
+		Action:    action,
+		PublicKey: config.PublicKey.String(),
+		config:    config,
+	}
+
+	for _, ip := range config.AllowedIPs {
+		change.AllowedIPs = append(change.AllowedIPs, ip.String())
+	}
+
+	return change
+}
+
+// PeerSet is a set of wireguard peers, which can be built up one peer at a time while the peers are being decoded
+type PeerSet struct {
+	peers map[wgtypes.Key][]net.IPNet
+}
+
+// NewPeerSet returns a new empty PeerSet
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		peers: make(map[wgtypes.Key][]net.IPNet),
+	}
+}
+
+// Add adds a peer to the set
+func (s *PeerSet) Add(peer api.WireguardPeer) {
+	// Ignore peers with errors, in-case we get bad data from the API
+	key, ipv4, ipv6, err := parsePeer(peer)
+	if err != nil {
+		return
+	}
+
+	s.peers[key] = []net.IPNet{
+		*ipv4,
+		*ipv6,
+	}
+}
+
+// Len returns the number of peers in the set
+func (s *PeerSet) Len() int {
+	return len(s.peers)
+}
+
 // UpdatePeers updates the configuration of the wireguard interfaces to match the given list of peers
 func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) {
-	peerMap := w.mapPeers(peers)
+	w.UpdatePeerSet(mapPeers(peers))
+}
 
-	for _, d := range w.interfaces {
+// UpdatePeerSet updates the configuration of the wireguard interfaces to match the given set of peers
+// Every interface is updated even if another one fails, and the first error is returned
+func (w *Wireguard) UpdatePeerSet(set *PeerSet) error {
+	peerMap := set.peers
 
-		device, err := w.client.Device(d)
+	var firstErr error
+	for _, d := range w.interfaces {
+		changes, err := w.diffPeers(d, peerMap)
 		// Log an error, but move on, so that one broken wireguard interface doesn't prevent us from configuring the rest
 		if err != nil {
 			log.Printf("error connecting to wireguard interface %s: %s", d, err.Error())
-			continue
-		}
-
-		existingPeerMap := mapExistingPeers(device.Peers)
-		cfgPeers := []wgtypes.PeerConfig{}
-
-		// Loop through peers from the API
-		// Add peers not currently existing in the wireguard config
-		// Update peers that exist in the wireguard config but has changed
-		for key, allowedIPs := range peerMap {
-			existingPeer, ok := existingPeerMap[key]
-			if !ok || !iputil.EqualIPNet(allowedIPs, existingPeer.AllowedIPs) {
-				cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
-					PublicKey:         key,
-					ReplaceAllowedIPs: true,
-					AllowedIPs:        allowedIPs,
-				})
-			}
-		}
-
-		// Loop through the current peers in the wireguard config
-		for key := range existingPeerMap {
-			if _, ok := peerMap[key]; !ok {
-				// Remove peers that doesn't exist in the API
-				cfgPeers = append(cfgPeers, wgtypes.PeerConfig{
-					PublicKey: key,
-					Remove:    true,
-				})
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error connecting to wireguard interface %s: %s", d, err.Error())
 			}
+			continue
 		}
 
 		// No changes needed
-		if len(cfgPeers) == 0 {
+		if len(changes) == 0 {
 			continue
 		}
 
+		cfgPeers := make([]wgtypes.PeerConfig, 0, len(changes))
+		for _, change := range changes {
+			cfgPeers = append(cfgPeers, change.config)
+		}
+
 		// Add new peers and remove deleted peers
 		err = w.client.ConfigureDevice(d, wgtypes.Config{
 			Peers: cfgPeers,
@@ -174,30 +235,92 @@ func (w *Wireguard) UpdatePeers(peers api.WireguardPeerList) {
 
 		if err != nil {
 			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			if firstErr == nil {
+				firstErr = fmt.Errorf("error configuring wireguard interface %s: %s", d, err.Error())
+			}
 			continue
 		}
 
 	}
+
+	return firstErr
 }
 
-// Take the wireguard peers and convert them into a map for easier comparison
-func (w *Wireguard) mapPeers(peers api.WireguardPeerList) (peerMap map[wgtypes.Key][]net.IPNet) {
-	peerMap = make(map[wgtypes.Key][]net.IPNet)
+// PlanPeers returns the changes UpdatePeers would make to the wireguard interfaces for the given list of peers, without applying them
+func (w *Wireguard) PlanPeers(peers api.WireguardPeerList) ([]PeerChange, error) {
+	peerMap := mapPeers(peers).peers
 
-	// Ignore peers with errors, in-case we get bad data from the API
-	for _, peer := range peers {
-		key, ipv4, ipv6, err := parsePeer(peer)
+	var changes []PeerChange
+	for _, d := range w.interfaces {
+		deviceChanges, err := w.diffPeers(d, peerMap)
 		if err != nil {
-			continue
+			return nil, fmt.Errorf("error connecting to wireguard interface %s: %s", d, err.Error())
 		}
 
-		peerMap[key] = []net.IPNet{
-			*ipv4,
-			*ipv6,
+		changes = append(changes, deviceChanges...)
+	}
+
+	sort.SliceStable(changes, func(i int, j int) bool {
+		if changes[i].Interface != changes[j].Interface {
+			return changes[i].Interface < changes[j].Interface
 		}
+
+		return changes[i].PublicKey < changes[j].PublicKey
+	})
+
+	return changes, nil
+}
+
+// Compare the peers of a wireguard interface with the given peers, and return the changes needed to make them match
+func (w *Wireguard) diffPeers(d string, peerMap map[wgtypes.Key][]net.IPNet) ([]PeerChange, error) {
+	device, err := w.client.Device(d)
+	if err != nil {
+		return nil, err
 	}
 
-	return
+	existingPeerMap := mapExistingPeers(device.Peers)
+	changes := []PeerChange{}
+
+	// Loop through peers from the API
+	// Add peers not currently existing in the wireguard config
+	// Update peers that exist in the wireguard config but has changed
+	for key, allowedIPs := range peerMap {
+		config := wgtypes.PeerConfig{
+			PublicKey:         key,
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        allowedIPs,
+		}
+
+		existingPeer, ok := existingPeerMap[key]
+		if !ok {
+			changes = append(changes, newPeerChange(d, ActionAdd, config))
+		} else if !iputil.EqualIPNet(allowedIPs, existingPeer.AllowedIPs) {
+			changes = append(changes, newPeerChange(d, ActionUpdate, config))
+		}
+	}
+
+	// Loop through the current peers in the wireguard config
+	for key := range existingPeerMap {
+		if _, ok := peerMap[key]; !ok {
+			// Remove peers that doesn't exist in the API
+			changes = append(changes, newPeerChange(d, ActionRemove, wgtypes.PeerConfig{
+				PublicKey: key,
+				Remove:    true,
+			}))
+		}
+	}
+
+	return changes, nil
+}
+
+// Take the wireguard peers and convert them into a set for easier comparison
+func mapPeers(peers api.WireguardPeerList) *PeerSet {
+	set := NewPeerSet()
+	for _, peer := range peers {
+		set.Add(peer)
+	}
+
+	return set
 }
 
 // Take the existing wireguard peers and convert them into a map for easier comparison
@@ -275,8 +398,14 @@ func (w *Wireguard) AddPeer(peer api.WireguardPeer) {
 }
 
 // RemovePeer removes the given peer from the wireguard interfaces, without checking the existing configuration
+// Only the public key of the peer is used
 func (w *Wireguard) RemovePeer(peer api.WireguardPeer) {
-	key, _, _, err := parsePeer(peer)
+	w.RemovePeerKey(peer.Pubkey)
+}
+
+// RemovePeerKey removes the peer with the given public key from the wireguard interfaces, without checking the existing configuration
+func (w *Wireguard) RemovePeerKey(pubkey string) {
+	key, err := wgtypes.ParseKey(pubkey)
 	if err != nil {
 		return
 	}
@@ -299,6 +428,53 @@ func (w *Wireguard) RemovePeer(peer api.WireguardPeer) {
 	}
 }
 
+// ApplyPeers adds or updates the added peers and removes the removed peers, with one configuration change per interface
+func (w *Wireguard) ApplyPeers(added []api.WireguardPeer, removed []api.WireguardPeer) {
+	var peers []wgtypes.PeerConfig
+	for _, peer := range removed {
+		key, _, _, err := parsePeer(peer)
+		if err != nil {
+			continue
+		}
+
+		peers = append(peers, wgtypes.PeerConfig{
+			PublicKey: key,
+			Remove:    true,
+		})
+	}
+
+	for _, peer := range added {
+		key, ipv4, ipv6, err := parsePeer(peer)
+		if err != nil {
+			continue
+		}
+
+		peers = append(peers, wgtypes.PeerConfig{
+			PublicKey:         key,
+			ReplaceAllowedIPs: true,
+			AllowedIPs: []net.IPNet{
+				*ipv4,
+				*ipv6,
+			},
+		})
+	}
+
+	if len(peers) == 0 {
+		return
+	}
+
+	for _, d := range w.interfaces {
+		err := w.client.ConfigureDevice(d, wgtypes.Config{
+			Peers: peers,
+		})
+
+		if err != nil {
+			log.Printf("error configuring wireguard interface %s: %s", d, err.Error())
+			continue
+		}
+	}
+}
+
 func parsePeer(peer api.WireguardPeer) (key wgtypes.Key, ipv4 *net.IPNet, ipv6 *net.IPNet, err error) {
 	key, err = wgtypes.ParseKey(peer.Pubkey)
 	if err != nil {